@@ -234,7 +234,13 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 
 	// Read in the freelist.
 	db.freelist = newFreelist()
-	db.freelist.read(db.page(db.meta().freelist))
+	db.freelist.pageSize = db.pageSize
+	db.freelist.maxPages = options.MaxFreelistPages
+	db.freelist.highWater = db.meta().pgid
+	if err := db.freelist.read(db.page(db.meta().freelist)); err != nil {
+		_ = db.close()
+		return nil, fmt.Errorf("freelist read error: %s", err)
+	}
 
 	// Mark the database as opened and return.
 	return db, nil
@@ -835,7 +841,7 @@ func (db *DB) allocate(count int) (*page, error) {
 	p.overflow = uint32(count - 1)
 
 	// Use pages from the freelist if they are available.
-	if p.id = db.freelist.allocate(count); p.id != 0 {
+	if p.id = db.freelist.allocateOverflow(p.overflow); p.id != 0 {
 		return p, nil
 	}
 
@@ -916,6 +922,13 @@ type Options struct {
 	// If initialMmapSize is smaller than the previous database size,
 	// it takes no effect.
 	InitialMmapSize int
+
+	// MaxFreelistPages is the largest number of pages the freelist may span
+	// when a transaction writes it. A commit that needs a larger freelist
+	// fails and is rolled back.
+	//
+	// If <=0, the freelist size is not limited.
+	MaxFreelistPages int
 }
 
 // DefaultOptions represent the options used if nil options are passed into Open().
@@ -583,6 +583,49 @@ func TestDB_Open_InitialMmapSize(t *testing.T) {
 	}
 }
 
+// Ensure that a commit fails if its freelist would exceed MaxFreelistPages.
+func TestDB_Open_MaxFreelistPages(t *testing.T) {
+	path := tempfile()
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0666, &bolt.Options{MaxFreelistPages: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a value large enough that freeing it needs a multi-page freelist.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 4<<20))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	})
+	if err == nil || !strings.Contains(err.Error(), "exceeding limit of 1") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The failed commit leaves the bucket in place.
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); len(v) != 4<<20 {
+			t.Fatalf("unexpected value length: %d", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a database cannot open a transaction when it's not open.
 func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
 	var db bolt.DB
@@ -1,17 +1,98 @@
 package bolt
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
+var (
+	// errNoContiguousSpace is returned by allocateChecked when the freelist
+	// does not have a contiguous block of the requested size. The errors
+	// below give the reason and match it with errors.Is.
+	errNoContiguousSpace = errors.New("no contiguous free space")
+
+	// errFragmented is returned by allocateChecked when the freelist holds
+	// enough free pages but no contiguous block of the requested size.
+	errFragmented error = &allocError{"free space too fragmented"}
+
+	// errNoSpace is returned by allocateChecked when the freelist holds fewer
+	// free pages than requested.
+	errNoSpace error = &allocError{"not enough free space"}
+)
+
+// allocError is a reason allocateChecked failed. Every allocError matches
+// errNoContiguousSpace, so callers that only check for that keep working.
+type allocError struct {
+	msg string
+}
+
+func (e *allocError) Error() string { return e.msg }
+
+// Is reports whether target is errNoContiguousSpace.
+func (e *allocError) Is(target error) bool { return target == errNoContiguousSpace }
+
+// unassignedTxid is the pending key for pages freed before their transaction
+// id is known. It is above every real txid so release never frees them.
+const unassignedTxid = txid(0xFFFFFFFFFFFFFFFF)
+
 // freelist represents a list of all pages that are available for allocation.
 // It also tracks pages that have been freed but are still in use by open transactions.
 type freelist struct {
-	ids     []pgid          // all free and available free page ids.
-	pending map[txid][]pgid // mapping of soon-to-be free page ids by tx.
-	cache   map[pgid]bool   // fast lookup of all free and pending page ids.
+	ids      []pgid                  // all free and available free page ids.
+	pending  map[txid][]pgid         // mapping of soon-to-be free page ids by tx.
+	cache    map[pgid]bool           // fast lookup of all free and pending page ids.
+	released txid                    // watermark of the last release with readers open.
+	spare    pgids                   // array for release to merge into; never aliases ids.
+	scratch  pgids                   // reused by release and reload to gather pending ids.
+	highest  pgid                    // highest page id ever allocated from the freelist.
+	shrink   bool                    // reclaims unused ids capacity after release.
+	hot      map[pgid]int            // per-page free counts; nil unless tracking hot pages.
+	maxPages int                     // max pages a written freelist may span; 0 is unlimited.
+	trace    io.Writer               // receives a record of each change; see startTrace.
+	scrub    func(start pgid, n int) // called on every block leaving the freelist.
+	alloc    allocator               // picks blocks for allocate; nil means first-fit.
+	mu       *sync.RWMutex           // if set, lets concurrentStats run alongside updates.
+
+	// Observers called for each block leaving the freelist, whichever method
+	// allocated it, and after each free.
+	onAllocate func(start pgid, n int)
+	onFree     func(txid txid, start pgid, n int)
+
+	// Runs of free ids below scanFrom are all shorter than scanMin pages, so
+	// first-fit scans for at least scanMin pages can begin at scanFrom. Adding
+	// ids to the freelist resets scanFrom to 0, which disables the skip.
+	scanFrom pgid
+	scanMin  int
+
+	// nextFrom is the page id just past the last next-fit allocation, where
+	// the next next-fit scan resumes.
+	nextFrom pgid
+
+	// largest caches the length of the longest run of free ids. It is 0 when
+	// unknown. Failed full scans by allocate fill it in. Adding ids clears it,
+	// and so does taking a block out of a run of that length.
+	largest int
+
+	// pageSize is the database page size, used by read to check that a
+	// page's id count fits in the page. 0 skips the check.
+	pageSize int
+
+	// highWater is the page id high water mark of the file. read and reload
+	// reject a freelist page whose overflow reaches it. 0 skips the check.
+	highWater pgid
+
+	// trusted skips the per-id checks in read for pages known to be valid.
+	trusted bool
 }
 
 // newFreelist returns an empty, initialized freelist.
@@ -22,9 +103,36 @@ func newFreelist() *freelist {
 	}
 }
 
+// newFreelistFromIDs returns a freelist with the given free page ids and no
+// pending pages. The ids are copied, sorted and deduplicated. An error is
+// returned if any id refers to a meta page.
+func newFreelistFromIDs(ids []pgid) (*freelist, error) {
+	f := newFreelist()
+	a := make(pgids, len(ids))
+	copy(a, ids)
+	sort.Sort(a)
+	for _, id := range a {
+		if id <= 1 {
+			return nil, fmt.Errorf("invalid free page id: %d", id)
+		}
+		if len(f.ids) == 0 || f.ids[len(f.ids)-1] != id {
+			f.ids = append(f.ids, id)
+		}
+	}
+	f.reindex()
+	return f, nil
+}
+
 // size returns the size of the page after serialization.
 func (f *freelist) size() int {
-	return pageHeaderSize + (int(unsafe.Sizeof(pgid(0))) * f.count())
+	n := f.count()
+	if n >= 0xFFFF {
+		// The first element will be used to store the count. See freelist.write.
+		n++
+	}
+	// The last element holds the page checksum.
+	n++
+	return pageHeaderSize + (int(unsafe.Sizeof(pgid(0))) * n)
 }
 
 // count returns count of pages on the freelist
@@ -46,6 +154,121 @@ func (f *freelist) pending_count() int {
 	return count
 }
 
+// freelistStats summarizes the shape of a freelist's free space. A run is a
+// maximal block of contiguous page ids.
+type freelistStats struct {
+	FreePages    int // pages available for allocation
+	PendingPages int // pages waiting on open transactions
+	FreeRuns     int // runs of available pages
+	PendingRuns  int // runs of pending pages, across all transactions
+	LargestRun   int // pages in the longest run of available pages
+	SmallestRun  int // pages in the shortest run of available pages
+}
+
+// stats returns statistics about the freelist's available and pending pages.
+func (f *freelist) stats() freelistStats {
+	s := freelistStats{FreePages: f.free_count(), PendingPages: f.pending_count()}
+	f.eachRun(func(i, n int) bool {
+		s.FreeRuns++
+		if n > s.LargestRun {
+			s.LargestRun = n
+		}
+		if s.SmallestRun == 0 || n < s.SmallestRun {
+			s.SmallestRun = n
+		}
+		return true
+	})
+
+	m := make(pgids, 0, s.PendingPages)
+	for _, ids := range f.pending {
+		m = append(m, ids...)
+	}
+	sort.Sort(m)
+	for i := range m {
+		if i == 0 || m[i] != m[i-1]+1 {
+			s.PendingRuns++
+		}
+	}
+	return s
+}
+
+// fragmentation returns how scattered the available pages are, from 0 when
+// they form a single run to nearly 1 when they are all isolated pages. It is
+// 1 minus the share of available pages in the longest run, or 0 when no pages
+// are available.
+func (f *freelist) fragmentation() float64 {
+	if len(f.ids) == 0 {
+		return 0
+	}
+	return 1 - float64(f.largestFree())/float64(len(f.ids))
+}
+
+// runHistogram returns the number of runs of contiguous free pages in each
+// power-of-two size class, keyed by the smallest size in the class: 1, 2, 4
+// and so on. If pending is true then pending pages are treated as free.
+func (f *freelist) runHistogram(pending bool) map[int]int {
+	h := make(map[int]int)
+	f.forEachSpan(pending, func(start pgid, n int) bool {
+		class := 1
+		for class*2 <= n {
+			class *= 2
+		}
+		h[class]++
+		return true
+	})
+	return h
+}
+
+// concurrentStats works like stats but may be called from another goroutine
+// while the freelist is in use, provided f.mu is set. Every method that
+// changes the free or pending pages holds f.mu exclusively while it does so.
+// Those methods must still be called from one goroutine at a time. The
+// onAllocate, onFree and scrub hooks run without f.mu held, so they may call
+// concurrentStats.
+func (f *freelist) concurrentStats() freelistStats {
+	if f.mu != nil {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+	}
+	return f.stats()
+}
+
+// freelistAccounting breaks down the pages of a file by their state.
+type freelistAccounting struct {
+	Free      uint64 // pages available for allocation
+	Pending   uint64 // pages freed by transactions that may still be read
+	Allocated uint64 // pages in use, excluding the two meta pages
+	Total     uint64 // pages in the file
+}
+
+// accounting returns the breakdown of a file of total pages. An error is
+// returned if the freelist refers to pages beyond the end of the file or
+// claims more pages than the file holds.
+func (f *freelist) accounting(total pgid) (freelistAccounting, error) {
+	a := freelistAccounting{
+		Free:    uint64(f.free_count()),
+		Pending: uint64(f.pending_count()),
+		Total:   uint64(total),
+	}
+
+	if n := len(f.ids); n > 0 && f.ids[n-1] >= total {
+		return a, fmt.Errorf("free page %d beyond end of file: %d", f.ids[n-1], total)
+	}
+	for _, ids := range f.pending {
+		for _, id := range ids {
+			if id >= total {
+				return a, fmt.Errorf("pending page %d beyond end of file: %d", id, total)
+			}
+		}
+	}
+	if a.Free+a.Pending+2 > a.Total {
+		return a, fmt.Errorf("freelist claims %d pages of %d", a.Free+a.Pending, a.Total)
+	}
+
+	a.Allocated = a.Total - a.Free - a.Pending - 2
+	return a, nil
+}
+
 // all returns a list of all free ids and all pending ids in one sorted list.
 func (f *freelist) all() []pgid {
 	m := make(pgids, 0)
@@ -58,15 +281,159 @@ func (f *freelist) all() []pgid {
 	return pgids(f.ids).merge(m)
 }
 
+// forEachPage calls fn with every available page id in order, then with every
+// pending page id grouped by transaction in no particular order. Unlike all,
+// it allocates nothing. Iteration stops early if fn returns false.
+func (f *freelist) forEachPage(fn func(id pgid) bool) {
+	for _, id := range f.ids {
+		if !fn(id) {
+			return
+		}
+	}
+	for _, ids := range f.pending {
+		for _, id := range ids {
+			if !fn(id) {
+				return
+			}
+		}
+	}
+}
+
+// digest returns a fingerprint of the free page ids. Two freelists with the
+// same free pages produce the same digest. Pending pages are excluded since
+// they are local to the transactions that freed them.
+func (f *freelist) digest() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, id := range f.ids {
+		binary.LittleEndian.PutUint64(buf[:], uint64(id))
+		_, _ = h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+// eachAllocatedRange calls fn for each run of allocated pages below total, in
+// page order. Pending pages are counted as allocated unless pendingFree is
+// set. The runs are found between the spans of forEachSpan, so the free ids
+// are never copied. Iteration stops early if fn returns false.
+func (f *freelist) eachAllocatedRange(total pgid, pendingFree bool, fn func(start pgid, size uint64) bool) {
+	var next pgid
+	var stopped bool
+	f.forEachSpan(pendingFree, func(start pgid, n int) bool {
+		if start >= total {
+			return false
+		}
+		if start > next && !fn(next, uint64(start-next)) {
+			stopped = true
+			return false
+		}
+		next = start + pgid(n)
+		return true
+	})
+	if !stopped && next < total {
+		fn(next, uint64(total-next))
+	}
+}
+
+// leaked returns the pages after the meta pages and below total that are
+// neither free, pending, nor in reachable, in page order. reachable holds the
+// pages found by walking the tree and must be sorted. A non-empty result means
+// pages have been lost to both the tree and the freelist.
+func (f *freelist) leaked(total pgid, reachable pgids) pgids {
+	var a pgids
+	f.eachAllocatedRange(total, true, func(start pgid, size uint64) bool {
+		for id := start; id < start+pgid(size); id++ {
+			if id <= 1 {
+				continue
+			}
+			for len(reachable) > 0 && reachable[0] < id {
+				reachable = reachable[1:]
+			}
+			if len(reachable) == 0 || reachable[0] != id {
+				a = append(a, id)
+			}
+		}
+		return true
+	})
+	return a
+}
+
 // allocate returns the starting page id of a contiguous list of pages of a given size.
 // If a contiguous block cannot be found then 0 is returned.
 func (f *freelist) allocate(n int) pgid {
-	if len(f.ids) == 0 {
-		return 0
+	a := f.alloc
+	if a == nil {
+		a = firstFitAllocator{}
+	}
+
+	// Skip the scan if the longest run is known to be too short.
+	var id pgid
+	if f.largest == 0 || n <= f.largest {
+		if i := a.pick(f, n); i >= 0 {
+			_assert(i+n <= len(f.ids) && f.ids[i+n-1] == f.ids[i]+pgid(n-1), "allocator picked non-contiguous block at index %d", i)
+			id = f.take(i, n)
+		}
+	}
+	return id
+}
+
+// largestFree returns the length of the longest run of contiguous free ids,
+// which is the largest n for which allocate can succeed. The result is cached
+// until the freelist's ids change.
+func (f *freelist) largestFree() int {
+	if f.largest == 0 {
+		f.eachRun(func(i, n int) bool {
+			if n > f.largest {
+				f.largest = n
+			}
+			return true
+		})
+	}
+	return f.largest
+}
+
+// allocator chooses which free pages allocate hands out.
+type allocator interface {
+	// pick returns the index in f.ids of the first of n contiguous free
+	// pages to allocate, or -1 if no block fits. It must not modify f.ids.
+	pick(f *freelist, n int) int
+}
+
+// firstFitAllocator picks the first contiguous block large enough.
+type firstFitAllocator struct{}
+
+func (firstFitAllocator) pick(f *freelist, n int) int { return f.firstFit(n) }
+
+// bestFitAllocator picks the smallest contiguous block large enough.
+type bestFitAllocator struct{}
+
+func (bestFitAllocator) pick(f *freelist, n int) int { return f.bestFit(n) }
+
+// nextFitAllocator picks the first contiguous block large enough at or after
+// the end of the previous next-fit allocation, wrapping around to the start
+// of the freelist. This spreads small allocations across the file instead of
+// repeatedly carving up the lowest runs.
+type nextFitAllocator struct{}
+
+func (nextFitAllocator) pick(f *freelist, n int) int { return f.nextFit(n) }
+
+// firstFit returns the index of the first contiguous block large enough to
+// hold n pages, or -1 if there is none.
+func (f *freelist) firstFit(n int) int {
+	if len(f.ids) == 0 || n < 1 {
+		return -1
+	}
+
+	// Skip the leading runs that a previous scan found too small for n.
+	var start int
+	if f.scanFrom != 0 && n >= f.scanMin {
+		start = sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= f.scanFrom })
 	}
 
 	var initial, previd pgid
-	for i, id := range f.ids {
+	var longest int
+	for i := start; i < len(f.ids); i++ {
+		id := f.ids[i]
 		if id <= 1 {
 			panic(fmt.Sprintf("invalid page allocation: %d", id))
 		}
@@ -76,57 +443,753 @@ func (f *freelist) allocate(n int) pgid {
 			initial = id
 		}
 
-		// If we found a contiguous block then remove it and return it.
+		// If we found a contiguous block then return it. Every run before
+		// it is smaller than n so later scans can start here.
 		if (id-initial)+1 == pgid(n) {
-			// If we're allocating off the beginning then take the fast path
-			// and just adjust the existing slice. This will use extra memory
-			// temporarily but the append() in free() will realloc the slice
-			// as is necessary.
-			if (i + 1) == n {
-				f.ids = f.ids[i+1:]
-			} else {
-				copy(f.ids[i-n+1:], f.ids[i+1:])
-				f.ids = f.ids[:len(f.ids)-n]
+			f.scanFrom, f.scanMin = initial, n
+			return i - n + 1
+		}
+		if size := int(id-initial) + 1; size > longest {
+			longest = size
+		}
+
+		previd = id
+	}
+	f.scanFrom, f.scanMin = f.ids[len(f.ids)-1]+1, n
+	if start == 0 {
+		f.largest = longest
+	}
+	return -1
+}
+
+// nextFit returns the index of the first contiguous block large enough to
+// hold n pages, scanning from nextFrom and wrapping around, or -1 if there is
+// none.
+func (f *freelist) nextFit(n int) int {
+	if len(f.ids) == 0 || n < 1 {
+		return -1
+	}
+
+	start := sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= f.nextFrom })
+	i := f.fitFrom(start, len(f.ids), n)
+	if i < 0 {
+		i = f.fitFrom(0, start, n)
+	}
+	if i >= 0 {
+		f.nextFrom = f.ids[i] + pgid(n)
+	}
+	return i
+}
+
+// fitFrom returns the index of the first contiguous block of at least n ids
+// that starts at an index in [lo, hi), or -1 if there is none. A block may
+// extend past hi.
+func (f *freelist) fitFrom(lo, hi, n int) int {
+	idx := -1
+	pgids(f.ids[lo:]).eachRun(func(i, size int) bool {
+		if i += lo; i >= hi {
+			return false
+		} else if size >= n {
+			idx = i
+			return false
+		}
+		return true
+	})
+	return idx
+}
+
+// bestFit returns the index of the smallest contiguous block large enough
+// to hold n pages, or -1 if there is none. This leaves bigger blocks intact
+// for larger requests. Ties go to the block with the lowest page id.
+func (f *freelist) bestFit(n int) int {
+	if len(f.ids) == 0 || n < 1 {
+		return -1
+	}
+
+	// Skip the leading runs that a previous scan found too small for n.
+	var start int
+	if f.scanFrom != 0 && n >= f.scanMin {
+		start = sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= f.scanFrom })
+	}
+
+	first, best, bestSize, longest := -1, -1, 0, 0
+	pgids(f.ids[start:]).eachRun(func(i, size int) bool {
+		i += start
+		if f.ids[i] <= 1 {
+			panic(fmt.Sprintf("invalid page allocation: %d", f.ids[i]))
+		}
+		if size > longest {
+			longest = size
+		}
+		if size >= n {
+			if first < 0 {
+				first = i
+			}
+			if best < 0 || size < bestSize {
+				best, bestSize = i, size
 			}
+		}
+		return size != n
+	})
+
+	// Every run before the first fit is smaller than n so later scans can
+	// start there. A failed scan of every run also finds the longest one.
+	if best < 0 {
+		f.scanFrom, f.scanMin = f.ids[len(f.ids)-1]+1, n
+		if start == 0 {
+			f.largest = longest
+		}
+		return -1
+	}
+	f.scanFrom, f.scanMin = f.ids[first], n
+	return best
+}
+
+// allocateChecked works like allocate but returns an error instead of a zero
+// page id when no contiguous block can be found. The error is errFragmented
+// if enough pages are free but not contiguous, and errNoSpace otherwise; both
+// match errNoContiguousSpace.
+func (f *freelist) allocateChecked(n int) (pgid, error) {
+	if id := f.allocate(n); id != 0 {
+		return id, nil
+	} else if len(f.ids) >= n {
+		return 0, errFragmented
+	}
+	return 0, errNoSpace
+}
+
+// allocateBounded works like allocate but gives up after examining maxScan
+// contiguous runs of free pages. The boolean result reports whether a block
+// was found; if not, the caller should grow the file rather than pay for an
+// unbounded scan of a fragmented freelist.
+func (f *freelist) allocateBounded(n int, maxScan int) (pgid, bool) {
+	if n < 1 {
+		return 0, false
+	}
+
+	// Count each run against the scan budget.
+	idx, runs := -1, 0
+	f.eachRun(func(i, size int) bool {
+		if f.ids[i] <= 1 {
+			panic(fmt.Sprintf("invalid page allocation: %d", f.ids[i]))
+		}
+		if runs == maxScan {
+			return false
+		}
+		runs++
+		if size >= n {
+			idx = i
+			return false
+		}
+		return true
+	})
+	if idx < 0 {
+		return 0, false
+	}
+	return f.take(idx, n), true
+}
+
+// allocateOverflow returns the starting page id of a contiguous block large
+// enough for a page with the given overflow count, mirroring page.overflow.
+// If a contiguous block cannot be found then 0 is returned.
+func (f *freelist) allocateOverflow(overflow uint32) pgid {
+	return f.allocate(int(overflow) + 1)
+}
+
+// reservation is a block of pages taken off the freelist by reserve. It must
+// be either committed or cancelled exactly once.
+type reservation struct {
+	start pgid
+	n     int
+	done  bool
+}
+
+// reserve removes a contiguous block of n pages from the freelist and returns
+// a reservation for it along with its starting page id. Cancelling the
+// reservation returns the pages without going through pending and release.
+// If a contiguous block cannot be found then a nil reservation and 0 are
+// returned.
+//
+// A reservation does not survive reload. The reloaded page still lists the
+// reserved pages as free, so a reservation outstanding across a reload must
+// be committed rather than cancelled.
+func (f *freelist) reserve(n int) (*reservation, pgid) {
+	id := f.allocate(n)
+	if id == 0 {
+		return nil, 0
+	}
+	return &reservation{start: id, n: n}, id
+}
+
+// commitReservation finalizes a reservation so its pages stay allocated.
+func (f *freelist) commitReservation(r *reservation) {
+	_assert(!r.done, "reservation at page %d already finished", r.start)
+	r.done = true
+}
+
+// cancelReservation returns a reservation's pages to the freelist.
+// If any of the pages is already free or pending then a panic will occur.
+func (f *freelist) cancelReservation(r *reservation) {
+	_assert(!r.done, "reservation at page %d already finished", r.start)
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	ids := make(pgids, r.n)
+	for i := range ids {
+		ids[i] = r.start + pgid(i)
+		if f.cache[ids[i]] {
+			panic(fmt.Sprintf("page %d already freed", ids[i]))
+		}
+	}
+	for _, id := range ids {
+		f.cache[id] = true
+	}
+	r.done = true
+	f.ids = pgids(f.ids).merge(ids)
+	f.scanFrom, f.largest = 0, 0
+
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "cancel %d %d\n", r.start, r.n)
+	}
+}
+
+// allocateRange allocates a contiguous block of at least min and at most max
+// pages from the first block holding at least min pages. It returns the
+// starting page id and the number of pages allocated, or 0, 0 if no block is
+// large enough. Any pages beyond max stay on the freelist.
+func (f *freelist) allocateRange(min, max int) (pgid, int) {
+	if min < 1 || max < min {
+		return 0, 0
+	}
+
+	idx, size := -1, 0
+	f.eachRun(func(i, n int) bool {
+		if n < min {
+			return true
+		}
+		idx, size = i, n
+		return false
+	})
+	if idx < 0 {
+		return 0, 0
+	}
+
+	if size > max {
+		size = max
+	}
+	return f.take(idx, size), size
+}
+
+// allocateFunc works like allocate but offers each run of free pages large
+// enough for n pages to accept, in page order, and allocates from the start of
+// the first run it accepts. If every candidate is rejected then 0 is returned.
+func (f *freelist) allocateFunc(n int, accept func(start pgid, size int) bool) pgid {
+	if n < 1 {
+		return 0
+	}
+
+	idx := -1
+	f.eachRun(func(i, size int) bool {
+		if size < n || !accept(f.ids[i], size) {
+			return true
+		}
+		idx = i
+		return false
+	})
+	if idx < 0 {
+		return 0
+	}
+	return f.take(idx, n)
+}
+
+// allocateN allocates n pages that need not be contiguous, taking the lowest
+// free ids first. It returns the allocated ids in order, or nil without
+// allocating if fewer than n pages are free.
+func (f *freelist) allocateN(n int) []pgid {
+	if n < 1 || len(f.ids) < n {
+		return nil
+	}
+
+	ids := make([]pgid, n)
+	copy(ids, f.ids[:n])
+	for n > 0 {
+		// Take the leading run of contiguous ids, up to the pages still needed.
+		size := 1
+		for size < n && f.ids[size] == f.ids[size-1]+1 {
+			size++
+		}
+		f.take(0, size)
+		n -= size
+	}
+	return ids
+}
+
+// allocateNear works like allocate but chooses the block of n contiguous free
+// pages whose first page is closest to hint, which may lie inside a longer
+// run. Ties go to the block after hint. If no block is large enough then 0 is
+// returned.
+func (f *freelist) allocateNear(n int, hint pgid) pgid {
+	if n < 1 {
+		return 0
+	}
+
+	idx, dist := -1, pgid(0)
+	f.eachRun(func(i, size int) bool {
+		if size < n {
+			return true
+		}
 
-			// Remove from the free cache.
-			for i := pgid(0); i < pgid(n); i++ {
-				delete(f.cache, initial+i)
+		// Runs are visited in page order, so the first run at or after hint
+		// is the last one worth considering.
+		start := f.ids[i]
+		if start >= hint {
+			if idx < 0 || start-hint <= dist {
+				idx = i
 			}
+			return false
+		}
 
-			return initial
+		// Otherwise take the block starting at hint if the run holds one,
+		// or else the last n pages of the run.
+		offset := size - n
+		if hint-start < pgid(offset) {
+			offset = int(hint - start)
 		}
+		idx, dist = i+offset, hint-start-pgid(offset)
+		return dist != 0
+	})
+	if idx < 0 {
+		return 0
+	}
+	return f.take(idx, n)
+}
 
-		previd = id
+// allocateHigh works like allocate but takes the last n pages of the highest
+// contiguous block large enough to hold them. Keeping low pages in use lets
+// the free pages collect at the end of the file.
+func (f *freelist) allocateHigh(n int) pgid {
+	if n < 1 {
+		return 0
+	}
+
+	for i := len(f.ids) - 1; i >= 0; {
+		j := i
+		for j > 0 && f.ids[j-1] == f.ids[j]-1 {
+			j--
+		}
+		if i-j+1 >= n {
+			return f.take(i-n+1, n)
+		}
+		i = j - 1
 	}
 	return 0
 }
 
+// allocateAt allocates exactly the n pages starting at start. It returns
+// false without changing the freelist unless every page in the range is free.
+func (f *freelist) allocateAt(start pgid, n int) bool {
+	if n < 1 {
+		return false
+	}
+
+	i := sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= start })
+	if i+n > len(f.ids) || f.ids[i] != start || f.ids[i+n-1] != start+pgid(n-1) {
+		return false
+	}
+	f.take(i, n)
+	return true
+}
+
+// allocateAligned works like allocate but only returns a block whose first
+// page id is a multiple of align. Free pages in front of the aligned start
+// stay on the freelist. If no block satisfies the constraint then 0 is
+// returned.
+func (f *freelist) allocateAligned(n, align int) pgid {
+	if n < 1 || align < 1 {
+		return 0
+	}
+	a := pgid(align)
+
+	idx := -1
+	f.eachRun(func(i, size int) bool {
+		start := (f.ids[i] + a - 1) / a * a
+		if start+pgid(n) > f.ids[i]+pgid(size) {
+			return true
+		}
+		idx = i + int(start-f.ids[i])
+		return false
+	})
+	if idx < 0 {
+		return 0
+	}
+	return f.take(idx, n)
+}
+
+// allocateBlockAligned works like allocate but only returns a block that
+// does not cross a boundary between groups of blockPages pages. A request for
+// at most blockPages pages must fit inside a single group. A larger request
+// must start on a boundary and cover whole groups. If no block satisfies the
+// constraint then 0 is returned.
+func (f *freelist) allocateBlockAligned(n, blockPages int) pgid {
+	if n < 1 || blockPages < 1 || (n > blockPages && n%blockPages != 0) {
+		return 0
+	}
+	bp := pgid(blockPages)
+
+	idx := -1
+	f.eachRun(func(i, size int) bool {
+		start, end := f.ids[i], f.ids[i]+pgid(size)
+		if n > blockPages || start/bp != (start+pgid(n)-1)/bp {
+			start = (start + bp - 1) / bp * bp
+		}
+		if start+pgid(n) > end {
+			return true
+		}
+		idx = i + int(start-f.ids[i])
+		return false
+	})
+	if idx < 0 {
+		return 0
+	}
+	return f.take(idx, n)
+}
+
+// quota limits how many pages each caller-defined class may hold. Classes
+// without an entry in limits are unrestricted.
+type quota struct {
+	limits map[int]int // maximum pages per class.
+	used   map[int]int // pages currently held per class.
+}
+
+// allocateWithQuota works like allocate but charges the pages to class and
+// returns 0 without allocating if that would take class over its limit.
+func (f *freelist) allocateWithQuota(n int, class int, q *quota) pgid {
+	if limit, ok := q.limits[class]; ok && q.used[class]+n > limit {
+		return 0
+	}
+
+	id := f.allocate(n)
+	if id != 0 {
+		if q.used == nil {
+			q.used = make(map[int]int)
+		}
+		q.used[class] += n
+	}
+	return id
+}
+
+// freeWithQuota works like free and credits the page and its overflow back
+// to class. The credit is immediate even though the pages stay pending until
+// release.
+func (f *freelist) freeWithQuota(txid txid, p *page, class int, q *quota) {
+	f.free(txid, p)
+	if n := q.used[class] - (int(p.overflow) + 1); n > 0 {
+		q.used[class] = n
+	} else {
+		delete(q.used, class)
+	}
+}
+
+// eachRun calls fn with the index and length of each run of contiguous page
+// ids on the freelist, in page order. Iteration stops early if fn returns false.
+func (f *freelist) eachRun(fn func(i, n int) bool) {
+	pgids(f.ids).eachRun(fn)
+}
+
+// forEachSpan calls fn with the first page id and length of each run of
+// contiguous free pages, in page order, without materializing the page ids.
+// If pending is true then pending pages are treated as free and merged into
+// the runs. Iteration stops early if fn returns false.
+func (f *freelist) forEachSpan(pending bool, fn func(start pgid, n int) bool) {
+	var p pgids
+	if pending {
+		for _, ids := range f.pending {
+			p = append(p, ids...)
+		}
+		sort.Sort(p)
+	}
+
+	var start pgid
+	var n int
+	for i, j := 0, 0; i < len(f.ids) || j < len(p); {
+		var id pgid
+		if j == len(p) || (i < len(f.ids) && f.ids[i] < p[j]) {
+			id, i = f.ids[i], i+1
+		} else {
+			id, j = p[j], j+1
+		}
+
+		if n > 0 && id == start+pgid(n) {
+			n++
+			continue
+		}
+		if n > 0 && !fn(start, n) {
+			return
+		}
+		start, n = id, 1
+	}
+	if n > 0 {
+		fn(start, n)
+	}
+}
+
+// take removes n contiguous page ids starting at index i from the freelist
+// and returns the first page id of the block.
+func (f *freelist) take(i, n int) pgid {
+	initial := f.ids[i]
+	f.remove(i, n)
+
+	// Let the data layer clear stale contents before the pages are reused.
+	if f.scrub != nil {
+		f.scrub(initial, n)
+	}
+	if f.onAllocate != nil {
+		f.onAllocate(initial, n)
+	}
+	return initial
+}
+
+// remove implements take without calling the hooks, which run after f.mu
+// is released.
+func (f *freelist) remove(i, n int) {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	initial := f.ids[i]
+
+	// The longest run only shrinks if the block comes from a run that long.
+	if f.largest > 0 {
+		lo, hi := i, i+n
+		for lo > 0 && f.ids[lo-1] == f.ids[lo]-1 {
+			lo--
+		}
+		for hi < len(f.ids) && f.ids[hi] == f.ids[hi-1]+1 {
+			hi++
+		}
+		if hi-lo >= f.largest {
+			f.largest = 0
+		}
+	}
+
+	// If we're allocating off the beginning then take the fast path
+	// and just adjust the existing slice. This will use extra memory
+	// temporarily but the append() in free() will realloc the slice
+	// as is necessary.
+	if i == 0 {
+		f.ids = f.ids[n:]
+	} else {
+		copy(f.ids[i:], f.ids[i+n:])
+		f.ids = f.ids[:len(f.ids)-n]
+	}
+
+	// Remove from the free cache.
+	for i := pgid(0); i < pgid(n); i++ {
+		delete(f.cache, initial+i)
+	}
+
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "take %d %d\n", initial, n)
+	}
+
+	if last := initial + pgid(n-1); last > f.highest {
+		f.highest = last
+	}
+
+	// Check that the ids on either side of the removed block are still in order.
+	if freelistDebug && i > 0 && i < len(f.ids) {
+		_assert(f.ids[i-1] < f.ids[i], "freelist unsorted after allocate: %d >= %d", f.ids[i-1], f.ids[i])
+	}
+}
+
 // free releases a page and its overflow for a given transaction id.
 // If the page is already free then a panic will occur.
 func (f *freelist) free(txid txid, p *page) {
+	f.addPending(txid, p)
+
+	if f.onFree != nil {
+		f.onFree(txid, p.id, int(p.overflow)+1)
+	}
+}
+
+// addPending implements free without calling onFree, which runs after f.mu
+// is released.
+func (f *freelist) addPending(txid txid, p *page) {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
 	if p.id <= 1 {
 		panic(fmt.Sprintf("cannot free page 0 or 1: %d", p.id))
 	}
 
-	// Free page and all its overflow pages.
+	// A page's contents are addressed as a single allocation of at most
+	// maxAllocSize bytes, so its last overflow page starts below that. With
+	// the page size unknown, assume one-byte pages. A larger value means the
+	// page header is corrupt.
+	if overflow := uint64(p.overflow); overflow >= maxAllocSize ||
+		(f.pageSize > 0 && overflow*uint64(f.pageSize) >= maxAllocSize) {
+		panic(fmt.Sprintf("page %d has implausible overflow: %d", p.id, p.overflow))
+	}
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "free %d %d %d\n", txid, p.id, p.overflow)
+	}
+
+	// Free page and all its overflow pages. The first free of a transaction
+	// sizes the pending list up front since transactions usually free many pages.
 	var ids = f.pending[txid]
+	if ids == nil {
+		n := int(p.overflow) + 1
+		if n < 64 {
+			n = 64
+		}
+		ids = make([]pgid, 0, n)
+	}
 	for id := p.id; id <= p.id+pgid(p.overflow); id++ {
 		// Verify that page is not already free.
 		if f.cache[id] {
 			panic(fmt.Sprintf("page %d already freed", id))
 		}
 
+		// Verify that the cache agrees with the available free list.
+		if freelistDebug {
+			i := sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= id })
+			_assert(i == len(f.ids) || f.ids[i] != id, "page %d freed while available", id)
+		}
+
 		// Add to the freelist and cache.
 		ids = append(ids, id)
 		f.cache[id] = true
+
+		if f.hot != nil {
+			f.hot[id]++
+		}
 	}
 	f.pending[txid] = ids
 }
 
+// hotPages returns the sorted ids of pages that have been freed at least
+// threshold times. Free counts are only kept when f.hot is non-nil.
+func (f *freelist) hotPages(threshold int) []pgid {
+	var a pgids
+	for id, n := range f.hot {
+		if n >= threshold {
+			a = append(a, id)
+		}
+	}
+	sort.Sort(a)
+	return a
+}
+
+// resetStats clears the freelist's diagnostic counters without changing the
+// set of free pages.
+func (f *freelist) resetStats() {
+	if f.hot != nil {
+		f.hot = make(map[pgid]int)
+	}
+}
+
+// unfree reverses a free of a page and its overflow by txid, removing them
+// from the pending list. It returns false and leaves the freelist unchanged if
+// any of the pages is not pending for txid.
+func (f *freelist) unfree(txid txid, p *page) bool {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	ids := f.pending[txid]
+	var n int
+	for _, id := range ids {
+		if id >= p.id && id <= p.id+pgid(p.overflow) {
+			n++
+		}
+	}
+	if n != int(p.overflow)+1 {
+		return false
+	}
+
+	a := ids[:0]
+	for _, id := range ids {
+		if id >= p.id && id <= p.id+pgid(p.overflow) {
+			delete(f.cache, id)
+			continue
+		}
+		a = append(a, id)
+	}
+	if len(a) == 0 {
+		delete(f.pending, txid)
+	} else {
+		f.pending[txid] = a
+	}
+
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "unfree %d %d %d\n", txid, p.id, p.overflow)
+	}
+	return true
+}
+
+// freePendingUnassigned releases a page and its overflow on behalf of a
+// transaction whose id has not been assigned yet. The pages are persisted like
+// any other pending pages but are never released until assignPending
+// attributes them to a transaction.
+func (f *freelist) freePendingUnassigned(p *page) {
+	f.free(unassignedTxid, p)
+}
+
+// rollbackUnassigned removes the pages freed by freePendingUnassigned that
+// have not been attributed to a transaction yet. A transaction that rolls back
+// before assignPending must call it as well as rollback, or the next write
+// would persist the pages as free while the tree still uses them.
+func (f *freelist) rollbackUnassigned() bool {
+	return f.rollback(unassignedTxid)
+}
+
+// assignPending attributes all unassigned pending pages to txid.
+func (f *freelist) assignPending(txid txid) {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	ids, ok := f.pending[unassignedTxid]
+	if !ok {
+		return
+	}
+	f.pending[txid] = append(f.pending[txid], ids...)
+	delete(f.pending, unassignedTxid)
+
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "assign %d\n", txid)
+	}
+}
+
 // release moves all page ids for a transaction id (or older) to the freelist.
+// In debug builds a panic will occur if txid is lower than a previously
+// released txid since the oldest open reader can never move backward. The
+// release made when no readers are open, which passes unassignedTxid-1, is
+// left out of the watermark: the next reader may be older than that.
 func (f *freelist) release(txid txid) {
-	m := make(pgids, 0)
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	if txid != unassignedTxid-1 {
+		if freelistDebug && txid < f.released {
+			panic(fmt.Sprintf("release watermark regressed: %d < %d", txid, f.released))
+		}
+		f.released = txid
+	}
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "release %d\n", txid)
+	}
+
+	m := f.scratch[:0]
 	for tid, ids := range f.pending {
 		if tid <= txid {
 			// Move transaction's pending pages to the available freelist.
@@ -135,19 +1198,317 @@ func (f *freelist) release(txid txid) {
 			delete(f.pending, tid)
 		}
 	}
-	sort.Sort(m)
-	f.ids = pgids(f.ids).merge(m)
+
+	// A long-running reader can leave nothing to release for many commits.
+	// Then the free ids and the cursors derived from them stay as they are.
+	if len(m) > 0 {
+		sort.Sort(m)
+		f.mergeReleased(m)
+	}
+	f.scratch = m[:0]
+
+	// Reallocate the free list if most of its backing array is unused.
+	if f.shrink && cap(f.ids) > 4*len(f.ids) {
+		ids := make([]pgid, len(f.ids))
+		copy(ids, f.ids)
+		f.ids, f.spare, f.scratch = ids, nil, nil
+	}
+}
+
+// mergeReleased merges sorted ids that are no longer pending into the
+// available ids. It merges into the array the previous release replaced, then
+// keeps the current one for the next release. The two never share memory.
+func (f *freelist) mergeReleased(m pgids) {
+	n := len(f.ids) + len(m)
+	dst := f.spare
+	if cap(dst) < n {
+		dst = make(pgids, n)
+	}
+	dst = dst[:n]
+	mergepgids(dst, f.ids, m)
+	f.ids, f.spare = dst, f.ids[:0]
+	f.scanFrom, f.largest = 0, 0
+
+	// Check that released pages did not overlap the available free list.
+	if freelistDebug {
+		for i := 1; i < len(f.ids); i++ {
+			_assert(f.ids[i-1] < f.ids[i], "freelist unsorted after release: %d >= %d", f.ids[i-1], f.ids[i])
+		}
+	}
 }
 
-// rollback removes the pages from a given pending tx.
-func (f *freelist) rollback(txid txid) {
+// rollback removes the pages from a given pending tx. It returns false if the
+// tx had no pending pages, which is expected for a tx that freed nothing but
+// can also reveal a repeated or misdirected rollback.
+func (f *freelist) rollback(txid txid) bool {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	if f.trace != nil {
+		fmt.Fprintf(f.trace, "rollback %d\n", txid)
+	}
+
 	// Remove page ids from cache.
-	for _, id := range f.pending[txid] {
+	ids := f.pending[txid]
+	for _, id := range ids {
 		delete(f.cache, id)
 	}
 
 	// Remove pages from pending list.
 	delete(f.pending, txid)
+	return len(ids) > 0
+}
+
+// oldestPending returns the lowest transaction id with pending pages and the
+// number of pages it holds. That transaction's pages are the next to become
+// available, so a read transaction older than it is what keeps them pending.
+// Pages not yet assigned to a transaction are ignored. ok is false if no
+// transaction has pending pages.
+func (f *freelist) oldestPending() (tid txid, pages int, ok bool) {
+	for t, ids := range f.pending {
+		if t == unassignedTxid {
+			continue
+		}
+		if !ok || t < tid {
+			tid, pages, ok = t, len(ids), true
+		}
+	}
+	return tid, pages, ok
+}
+
+// dump writes a human-readable summary of the freelist to w: the runs of
+// available pages, the runs of pending pages for each transaction in txid
+// order, and page totals. Each run is written as [start,end].
+func (f *freelist) dump(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "free:%s\n", formatRuns(f.ids)); err != nil {
+		return err
+	}
+
+	tids := make([]txid, 0, len(f.pending))
+	for tid := range f.pending {
+		tids = append(tids, tid)
+	}
+	sort.Sort(txids(tids))
+	for _, tid := range tids {
+		ids := make(pgids, len(f.pending[tid]))
+		copy(ids, f.pending[tid])
+		sort.Sort(ids)
+
+		name := fmt.Sprint(tid)
+		if tid == unassignedTxid {
+			name = "unassigned"
+		}
+		if _, err := fmt.Fprintf(w, "pending %s:%s\n", name, formatRuns(ids)); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "total: %d free, %d pending\n", f.free_count(), f.pending_count())
+	return err
+}
+
+// formatRuns formats sorted page ids as a list of [start,end] runs, each
+// preceded by a space.
+func formatRuns(ids []pgid) string {
+	var buf bytes.Buffer
+	pgids(ids).eachRun(func(i, n int) bool {
+		fmt.Fprintf(&buf, " [%d,%d]", ids[i], ids[i+n-1])
+		return true
+	})
+	return buf.String()
+}
+
+type txids []txid
+
+func (s txids) Len() int           { return len(s) }
+func (s txids) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s txids) Less(i, j int) bool { return s[i] < s[j] }
+
+// startTrace begins recording each change to the freelist to w. The trace
+// opens with the current free and pending pages so that replayTrace can
+// rebuild the freelist's history on an empty freelist.
+func (f *freelist) startTrace(w io.Writer) {
+	f.trace = w
+	f.traceIDs("init", f.ids)
+
+	tids := make([]txid, 0, len(f.pending))
+	for tid := range f.pending {
+		tids = append(tids, tid)
+	}
+	sort.Sort(txids(tids))
+	for _, tid := range tids {
+		f.traceIDs(fmt.Sprintf("pending %d", tid), f.pending[tid])
+	}
+}
+
+// traceIDs records op followed by a list of page ids.
+func (f *freelist) traceIDs(op string, ids []pgid) {
+	w := bufio.NewWriter(f.trace)
+	_, _ = w.WriteString(op)
+	for _, id := range ids {
+		_, _ = fmt.Fprintf(w, " %d", id)
+	}
+	_ = w.WriteByte('\n')
+	_ = w.Flush()
+}
+
+// replayTrace applies the records written by startTrace to another freelist.
+// An error is returned if a record is malformed or if a recorded block of
+// pages is not free when it is taken again.
+func (f *freelist) replayTrace(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxAllocSize)
+	for line := 1; scanner.Scan(); line++ {
+		op, args, err := parseTraceRecord(scanner.Text())
+		if err == nil {
+			err = f.replayRecord(op, args)
+		}
+		if err != nil {
+			return fmt.Errorf("trace line %d: %s", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// traceArity holds the number of arguments of each trace record that does
+// not end in a list of page ids.
+var traceArity = map[string]int{
+	"take":     2,
+	"cancel":   2,
+	"free":     3,
+	"unfree":   3,
+	"assign":   1,
+	"release":  1,
+	"rollback": 1,
+}
+
+// parseTraceRecord splits a trace record into its operation and arguments.
+func parseTraceRecord(text string) (op string, args []uint64, err error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil, errors.New("empty record")
+	}
+	op, args = fields[0], make([]uint64, len(fields)-1)
+	for i, s := range fields[1:] {
+		if args[i], err = strconv.ParseUint(s, 10, 64); err != nil {
+			return "", nil, fmt.Errorf("invalid argument %q", s)
+		}
+	}
+	if n, ok := traceArity[op]; ok && len(args) != n {
+		return "", nil, fmt.Errorf("%s: expected %d arguments, got %d", op, n, len(args))
+	}
+	return op, args, nil
+}
+
+// replayRecord applies a single parsed trace record.
+func (f *freelist) replayRecord(op string, args []uint64) error {
+	ids := func(a []uint64) []pgid {
+		ids := make([]pgid, len(a))
+		for i := range a {
+			ids[i] = pgid(a[i])
+		}
+		return ids
+	}
+
+	// Records that set the freelist's contents are applied here under f.mu.
+	// The others go through methods that take it themselves.
+	switch op {
+	case "init", "pending", "read", "reload":
+		if f.mu != nil {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+		}
+	}
+
+	switch op {
+	case "init":
+		f.ids, f.pending = ids(args), make(map[txid][]pgid)
+		f.reindex()
+	case "pending":
+		if len(args) == 0 {
+			return errors.New("pending: missing txid")
+		}
+		f.pending[txid(args[0])] = ids(args[1:])
+		f.reindex()
+	case "read":
+		f.ids = ids(args)
+		f.reindex()
+	case "reload":
+		prev := f.ids
+		f.ids = ids(args)
+		f.reindex()
+		f.dropPending(prev)
+	case "take":
+		if !f.allocateAt(pgid(args[0]), int(args[1])) {
+			return fmt.Errorf("take: %d pages at %d are not free", args[1], args[0])
+		}
+	case "cancel":
+		f.cancelReservation(&reservation{start: pgid(args[0]), n: int(args[1])})
+	case "free":
+		f.free(txid(args[0]), &page{id: pgid(args[1]), overflow: uint32(args[2])})
+	case "unfree":
+		if !f.unfree(txid(args[0]), &page{id: pgid(args[1]), overflow: uint32(args[2])}) {
+			return fmt.Errorf("unfree: page %d is not pending in tx %d", args[1], args[0])
+		}
+	case "assign":
+		f.assignPending(txid(args[0]))
+	case "release":
+		f.release(txid(args[0]))
+	case "rollback":
+		f.rollback(txid(args[0]))
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+	return nil
+}
+
+// verify checks the freelist's internal invariants: available ids are sorted,
+// unique and above the meta pages, each pending page is pending in only one
+// transaction and is not also available, and the cache holds exactly the
+// available and pending pages. It returns an error describing the first
+// violation found.
+func (f *freelist) verify() error {
+	for i, id := range f.ids {
+		if id <= 1 {
+			return fmt.Errorf("invalid free page id at index %d: %d", i, id)
+		} else if i > 0 && f.ids[i-1] >= id {
+			return fmt.Errorf("free page ids out of order at index %d: %d >= %d", i, f.ids[i-1], id)
+		}
+	}
+
+	owner := make(map[pgid]txid)
+	for tid, ids := range f.pending {
+		for _, id := range ids {
+			if id <= 1 {
+				return fmt.Errorf("invalid pending page id in tx %d: %d", tid, id)
+			} else if other, ok := owner[id]; ok {
+				return fmt.Errorf("page %d pending in tx %d and tx %d", id, other, tid)
+			}
+			owner[id] = tid
+		}
+	}
+	for _, id := range f.ids {
+		if tid, ok := owner[id]; ok {
+			return fmt.Errorf("page %d both free and pending in tx %d", id, tid)
+		}
+	}
+
+	if len(f.cache) != len(f.ids)+len(owner) {
+		return fmt.Errorf("free page cache has %d pages, expected %d", len(f.cache), len(f.ids)+len(owner))
+	}
+	for _, id := range f.ids {
+		if !f.cache[id] {
+			return fmt.Errorf("free page %d missing from cache", id)
+		}
+	}
+	for id := range owner {
+		if !f.cache[id] {
+			return fmt.Errorf("pending page %d missing from cache", id)
+		}
+	}
+	return nil
 }
 
 // freed returns whether a given page is in the free list.
@@ -155,44 +1516,188 @@ func (f *freelist) freed(pgid pgid) bool {
 	return f.cache[pgid]
 }
 
-// read initializes the freelist from a freelist page.
-func (f *freelist) read(p *page) {
-	// If the page.count is at the max uint16 value (64k) then it's considered
-	// an overflow and the size of the freelist is stored as the first element.
-	idx, count := 0, int(p.count)
-	if count == 0xFFFF {
-		idx = 1
-		count = int(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0])
+// read initializes the freelist from a freelist page. It returns an error if
+// the page's id count does not fit the page. Unless f.trusted is set, it also
+// returns an error if the page holds a meta page id or the same id twice.
+// Unsorted ids are sorted rather than rejected.
+func (f *freelist) read(p *page) error {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	if err := f.load(p); err != nil {
+		return err
+	}
+	if f.trace != nil {
+		f.traceIDs("read", f.ids)
+	}
+	return nil
+}
+
+// load implements read for callers that already hold f.mu.
+func (f *freelist) load(p *page) error {
+	ids, err := freelistPageIDs(p, f.pageSize, f.highWater)
+	if err != nil {
+		return err
 	}
 
 	// Copy the list of page ids from the freelist.
-	if count == 0 {
-		f.ids = nil
-	} else {
-		ids := ((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx:count]
-		f.ids = make([]pgid, len(ids))
-		copy(f.ids, ids)
+	var a []pgid
+	if len(ids) > 0 {
+		a = make([]pgid, len(ids))
+		copy(a, ids)
 
 		// Make sure they're sorted.
-		sort.Sort(pgids(f.ids))
+		sort.Sort(pgids(a))
+	}
+
+	if !f.trusted {
+		for i, id := range a {
+			if id <= 1 {
+				return fmt.Errorf("invalid freelist page id: %d", id)
+			} else if i > 0 && a[i-1] == id {
+				return fmt.Errorf("duplicate freelist page id: %d", id)
+			}
+		}
 	}
+	f.ids = a
 
 	// Rebuild the page cache.
 	f.reindex()
+	return nil
+}
+
+// readEach decodes a freelist page, passing each stored page id to fn in
+// on-disk order instead of populating the freelist. It stops and returns the
+// first error returned by fn.
+func (f *freelist) readEach(p *page, fn func(id pgid) error) error {
+	ids, err := freelistPageIDs(p, f.pageSize, f.highWater)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStrict initializes the freelist from a freelist page like read but
+// returns an error instead of repairing a page that is not exactly as write
+// would have produced it.
+func (f *freelist) readStrict(p *page) error {
+	if (p.flags & freelistPageFlag) == 0 {
+		return fmt.Errorf("invalid freelist page: %d, page type is %s", p.id, p.typ())
+	}
+
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+
+	ids, err := freelistPageIDs(p, f.pageSize, f.highWater)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if id <= 1 {
+			return fmt.Errorf("invalid freelist page id at index %d: %d", i, id)
+		} else if i > 0 && ids[i-1] >= id {
+			return fmt.Errorf("freelist page ids out of order at index %d: %d >= %d", i, ids[i-1], id)
+		}
+	}
+
+	f.ids = nil
+	if len(ids) > 0 {
+		f.ids = make([]pgid, len(ids))
+		copy(f.ids, ids)
+	}
+	f.reindex()
+
+	if f.trace != nil {
+		f.traceIDs("read", f.ids)
+	}
+	return nil
+}
+
+// freelistPageIDs returns the page ids stored on a freelist page.
+// The returned slice refers to the page's memory. An error is returned if the
+// page and its overflow reach highWater, or if the stored count does not fit
+// in them, assuming pages of pageSize bytes. If pageSize is 0 then only the
+// addressable limit is checked, and if highWater is 0 then the overflow is
+// trusted.
+func freelistPageIDs(p *page, pageSize int, highWater pgid) ([]pgid, error) {
+	// Check the overflow before reading anything past the first page.
+	if last := p.id + pgid(p.overflow); highWater > 0 && (last >= highWater || last < p.id) {
+		return nil, fmt.Errorf("freelist page %d: overflow %d reaches high water mark %d", p.id, p.overflow, highWater)
+	}
+
+	// If the page.count is at the max uint16 value (64k) then it's considered
+	// an overflow and the size of the freelist is stored as the first element.
+	idx, count := uint64(0), uint64(p.count)
+	if count == 0xFFFF {
+		idx = 1
+		count = uint64(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0])
+	}
+
+	limit := uint64(maxAllocSize)
+	if pageSize > 0 {
+		limit = 0
+		if size := (uint64(p.overflow) + 1) * uint64(pageSize); size > uint64(pageHeaderSize) {
+			limit = (size - uint64(pageHeaderSize)) / uint64(unsafe.Sizeof(pgid(0)))
+		}
+		if limit > maxAllocSize {
+			limit = maxAllocSize
+		}
+	}
+
+	// Leave room for the checksum element.
+	var reserved uint64
+	if (p.flags & freelistChecksumFlag) != 0 {
+		reserved = 1
+	}
+	if count > limit || idx+count+reserved > limit {
+		var capacity uint64
+		if limit > idx+reserved {
+			capacity = limit - idx - reserved
+		}
+		return nil, fmt.Errorf("freelist page %d: count %d exceeds page capacity %d", p.id, count, capacity)
+	}
+
+	if reserved != 0 {
+		sum := uint64(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx+count])
+		if sum != freelistPageChecksum(p, idx+count) {
+			return nil, fmt.Errorf("freelist page %d: checksum mismatch", p.id)
+		}
+	}
+
+	if count == 0 {
+		return nil, nil
+	}
+	return ((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx : idx+count], nil
 }
 
 // write writes the page ids onto a freelist page. All free and pending ids are
 // saved to disk since in the event of a program crash, all pending ids will
-// become free.
+// become free. An error is returned if the page and its overflow exceed
+// f.maxPages.
 func (f *freelist) write(p *page) error {
+	// Refuse to write a freelist larger than the configured limit.
+	if n := int(p.overflow) + 1; f.maxPages > 0 && n > f.maxPages {
+		return fmt.Errorf("freelist requires %d pages, exceeding limit of %d", n, f.maxPages)
+	}
+
 	// Combine the old free pgids and pgids waiting on an open transaction.
 	ids := f.all()
 
 	// Update the header flag.
-	p.flags |= freelistPageFlag
+	p.flags |= freelistPageFlag | freelistChecksumFlag
 
 	// The page.count can only hold up to 64k elements so if we overflow that
 	// number then we handle it by putting the size in the first element.
+	n := uint64(len(ids))
 	if len(ids) == 0 {
 		p.count = uint16(len(ids))
 	} else if len(ids) < 0xFFFF {
@@ -202,40 +1707,78 @@ func (f *freelist) write(p *page) error {
 		p.count = 0xFFFF
 		((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0] = pgid(len(ids))
 		copy(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[1:], ids)
+		n++
 	}
 
+	// Follow the ids with a checksum of everything before it.
+	((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[n] = pgid(freelistPageChecksum(p, n))
+
 	return nil
 }
 
+// freelistPageChecksum returns the checksum of the first n elements of a
+// freelist page.
+func freelistPageChecksum(p *page, n uint64) uint64 {
+	var h = fnv.New64a()
+	_, _ = h.Write((*[maxAllocSize]byte)(unsafe.Pointer(&p.ptr))[:n*uint64(unsafe.Sizeof(pgid(0)))])
+	return h.Sum64()
+}
+
 // reload reads the freelist from a page and filters out pending items.
-func (f *freelist) reload(p *page) {
-	f.read(p)
+// It returns the available page ids that were added and removed by the reload.
+// If the page cannot be read then an error is returned and the freelist is
+// left unchanged.
+func (f *freelist) reload(p *page) (added, removed pgids, err error) {
+	if f.mu != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
 
-	// Build a cache of only pending pages.
-	pcache := make(map[pgid]bool)
-	for _, pendingIDs := range f.pending {
-		for _, pendingID := range pendingIDs {
-			pcache[pendingID] = true
-		}
+	prev := f.ids
+	if err := f.load(p); err != nil {
+		return nil, nil, err
+	}
+	if f.trace != nil {
+		f.traceIDs("reload", f.ids)
 	}
+	added, removed = f.dropPending(prev)
+	return added, removed, nil
+}
 
-	// Check each page in the freelist and build a new available freelist
-	// with any pages not in the pending lists.
-	var a []pgid
-	for _, id := range f.ids {
-		if !pcache[id] {
-			a = append(a, id)
-		}
+// dropPending removes the pending pages from ids just loaded from a freelist
+// page, which lists them as free. It returns the available page ids that were
+// added and removed since prev.
+func (f *freelist) dropPending(prev pgids) (added, removed pgids) {
+	// With nothing pending the page already holds exactly the available ids.
+	if len(f.pending) == 0 {
+		return prev.diff(f.ids)
 	}
-	f.ids = a
+
+	// Remove the pending pages from the available list in a single pass.
+	m := f.scratch[:0]
+	for _, pendingIDs := range f.pending {
+		m = append(m, pendingIDs...)
+	}
+	sort.Sort(m)
+	f.ids = pgids(f.ids).difference(m)
+	f.scratch = m[:0]
 
 	// Once the available list is rebuilt then rebuild the free cache so that
 	// it includes the available and pending free pages.
 	f.reindex()
+
+	if freelistDebug {
+		if err := f.verify(); err != nil {
+			panic(fmt.Sprintf("freelist reload: %s", err))
+		}
+	}
+
+	return prev.diff(f.ids)
 }
 
 // reindex rebuilds the free cache based on available and pending free lists.
 func (f *freelist) reindex() {
+	f.scanFrom, f.nextFrom, f.largest = 0, 0, 0
 	f.cache = make(map[pgid]bool, len(f.ids))
 	for _, id := range f.ids {
 		f.cache[id] = true
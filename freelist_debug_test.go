@@ -0,0 +1,111 @@
+// +build boltdebug
+
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that freeing an available page is caught in debug builds.
+func TestFreelist_debug_free(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{12}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	f.free(100, &page{id: 12})
+}
+
+// Ensure that releasing a page that is already available is caught in debug builds.
+func TestFreelist_debug_release(t *testing.T) {
+	f := &freelist{ids: []pgid{12}, pending: map[txid][]pgid{100: {12}}}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	f.release(100)
+}
+
+// Ensure that a release watermark regression is caught in debug builds.
+func TestFreelist_debug_releaseRegression(t *testing.T) {
+	f := newFreelist()
+	f.release(5)
+	f.release(unassignedTxid - 1)
+	f.release(5)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	f.release(4)
+}
+
+// Ensure that write transactions around readers keep the release watermark
+// moving forward, including after a release with no readers open.
+func TestFreelist_debug_releaseWatermark(t *testing.T) {
+	file, err := ioutil.TempFile("", "bolt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+
+	// Map enough up front that writes never remap while a reader is open.
+	db, err := Open(path, 0666, &Options{InitialMmapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func() {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte("bar"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Release everything with no readers, then hold a reader open.
+	put()
+	put()
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put()
+	put()
+	if exp := rtx.meta.txid - 1; db.freelist.released != exp {
+		t.Fatalf("exp=%d; got=%d", exp, db.freelist.released)
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer reader moves the watermark forward.
+	put()
+	rtx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put()
+	if exp := rtx.meta.txid - 1; db.freelist.released != exp {
+		t.Fatalf("exp=%d; got=%d", exp, db.freelist.released)
+	}
+
+	// Close explicitly: a panic above leaves the writer lock held.
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,7 @@
+// +build !boltdebug
+
+package bolt
+
+// freelistDebug enables incremental freelist invariant checks after every
+// mutation. Build with the boltdebug tag to turn them on.
+const freelistDebug = false
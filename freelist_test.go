@@ -1,13 +1,35 @@
 package bolt
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
 	"math/rand"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"unsafe"
 )
 
+// Ensure that a freelist can be built from an unsorted list of ids.
+func TestFreelist_newFreelistFromIDs(t *testing.T) {
+	f, err := newFreelistFromIDs([]pgid{9, 3, 4, 9})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []pgid{3, 4, 9}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if !f.freed(4) || f.freed(5) {
+		t.Fatal("unexpected cache contents")
+	}
+
+	if _, err := newFreelistFromIDs([]pgid{3, 1}); err == nil || err.Error() != "invalid free page id: 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // Ensure that a page is added to a transaction's freelist.
 func TestFreelist_free(t *testing.T) {
 	f := newFreelist()
@@ -26,6 +48,145 @@ func TestFreelist_free_overflow(t *testing.T) {
 	}
 }
 
+// Ensure that rollback reports whether it removed any pending pages.
+func TestFreelist_rollback(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 12, overflow: 1})
+	f.free(101, &page{id: 20})
+	if !f.rollback(100) {
+		t.Fatal("expected pages to be rolled back")
+	}
+	if f.rollback(100) {
+		t.Fatal("expected repeated rollback to remove nothing")
+	}
+	if f.freed(12) || !f.freed(20) {
+		t.Fatalf("unexpected cache: %v", f.cache)
+	}
+}
+
+// Ensure that pages freed repeatedly are reported as hot.
+func TestFreelist_hotPages(t *testing.T) {
+	f := newFreelist()
+	f.hot = make(map[pgid]int)
+	for i := 0; i < 3; i++ {
+		f.free(100, &page{id: 12, overflow: 1})
+		f.free(100, &page{id: 20})
+		f.rollback(100)
+	}
+	f.free(100, &page{id: 12})
+
+	if exp := []pgid{12}; !reflect.DeepEqual(exp, f.hotPages(4)) {
+		t.Fatalf("exp=%v; got=%v", exp, f.hotPages(4))
+	}
+	if exp := []pgid{12, 13, 20}; !reflect.DeepEqual(exp, f.hotPages(3)) {
+		t.Fatalf("exp=%v; got=%v", exp, f.hotPages(3))
+	}
+
+	f.resetStats()
+	if got := f.hotPages(1); len(got) != 0 {
+		t.Fatalf("unexpected hot pages: %v", got)
+	}
+}
+
+// Ensure that unassigned pending pages are held until attributed to a txid.
+func TestFreelist_assignPending(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 3})
+	f.freePendingUnassigned(&page{id: 12, overflow: 1})
+	f.release(1000)
+	if exp := []pgid{3}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if exp := []pgid{3, 12, 13}; !reflect.DeepEqual(exp, f.all()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.all())
+	}
+
+	f.assignPending(101)
+	if exp := []pgid{12, 13}; !reflect.DeepEqual(exp, f.pending[101]) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[101])
+	}
+	f.release(1001)
+	if exp := []pgid{3, 12, 13}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that unassigned pages freed by a transaction that rolls back are not persisted.
+func TestFreelist_rollbackUnassigned(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 3})
+	f.freePendingUnassigned(&page{id: 12, overflow: 1})
+	if !f.rollbackUnassigned() {
+		t.Fatal("expected unassigned pages to be removed")
+	} else if f.freed(12) || f.freed(13) {
+		t.Fatal("expected pages 12 and 13 to be in use")
+	}
+
+	f.assignPending(101)
+	if exp := []pgid{3}; !reflect.DeepEqual(exp, f.all()) {
+		t.Fatalf("exp=%v; got=%v", exp, f.all())
+	} else if f.rollbackUnassigned() {
+		t.Fatal("expected nothing to remove")
+	}
+}
+
+// Ensure that freeing a page with a corrupt overflow count panics.
+func TestFreelist_free_corruptOverflow(t *testing.T) {
+	f := newFreelist()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		} else if f.count() != 0 {
+			t.Fatalf("unexpected count: %d", f.count())
+		}
+	}()
+	f.free(100, &page{id: 12, overflow: 0xFFFFFFFF})
+}
+
+// Ensure that the overflow bound scales with the page size.
+func TestFreelist_free_corruptOverflow_pageSize(t *testing.T) {
+	const pageSize = 1 << 20
+	max := uint32((maxAllocSize - 1) / pageSize)
+
+	f := newFreelist()
+	f.pageSize = pageSize
+	f.free(100, &page{id: 12, overflow: max})
+	if exp := int(max) + 1; f.count() != exp {
+		t.Fatalf("exp=%d; got=%d", exp, f.count())
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		} else if exp := int(max) + 1; f.count() != exp {
+			t.Fatalf("exp=%d; got=%d", exp, f.count())
+		}
+	}()
+	f.free(101, &page{id: 12 + pgid(max) + 1, overflow: max + 1})
+}
+
+// Ensure that a free can be undone within its transaction.
+func TestFreelist_unfree(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 12, overflow: 1})
+	f.free(100, &page{id: 9})
+	if f.unfree(101, &page{id: 9}) || f.unfree(100, &page{id: 9, overflow: 1}) {
+		t.Fatal("unexpected unfree of pages not pending")
+	}
+	if !f.unfree(100, &page{id: 12, overflow: 1}) {
+		t.Fatal("expected unfree")
+	} else if exp := []pgid{9}; !reflect.DeepEqual(exp, f.pending[100]) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[100])
+	} else if f.freed(12) || f.freed(13) {
+		t.Fatal("expected pages to no longer be freed")
+	}
+
+	if !f.unfree(100, &page{id: 9}) {
+		t.Fatal("expected unfree")
+	} else if _, ok := f.pending[100]; ok {
+		t.Fatal("expected empty pending list to be removed")
+	}
+}
+
 // Ensure that a transaction's free pages can be released.
 func TestFreelist_release(t *testing.T) {
 	f := newFreelist()
@@ -44,6 +205,396 @@ func TestFreelist_release(t *testing.T) {
 	}
 }
 
+// Ensure that release reuses its merge buffer without aliasing the free ids.
+func TestFreelist_release_reuse(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 6, 7, 8}
+	f.reindex()
+	for tx := txid(100); tx < 110; tx++ {
+		id := f.allocate(1)
+		f.free(tx, &page{id: id})
+		f.release(tx)
+	}
+	if exp := []pgid{3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+
+	// Scribbling over the spare array must not disturb the free ids.
+	spare := f.spare[:cap(f.spare)]
+	for i := range spare {
+		spare[i] = 0
+	}
+	if exp := []pgid{3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a page with more than 65535 overflow pages can be freed and
+// reallocated as one block.
+func TestFreelist_free_largeOverflow(t *testing.T) {
+	f := newFreelist()
+	f.free(100, &page{id: 12, overflow: 70000})
+	f.release(100)
+	if n := f.free_count(); n != 70001 {
+		t.Fatalf("exp=70001; got=%v", n)
+	}
+	if id := f.allocate(70001); id != 12 {
+		t.Fatalf("exp=12; got=%v", id)
+	}
+}
+
+// Ensure that a release with nothing to release keeps the scan state.
+func TestFreelist_release_nothing(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 5, 6}
+	f.reindex()
+	f.free(100, &page{id: 12})
+	if n := f.largestFree(); n != 2 {
+		t.Fatalf("exp=2; got=%v", n)
+	}
+	f.allocate(3)
+	scanFrom := f.scanFrom
+
+	f.release(99)
+	if f.scanFrom != scanFrom || f.largest != 2 {
+		t.Fatalf("unexpected cursor: %v,%v", f.scanFrom, f.largest)
+	} else if exp := []pgid{12}; !reflect.DeepEqual(exp, f.pending[100]) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[100])
+	}
+}
+
+// Ensure that every free and pending page is visited until fn stops.
+func TestFreelist_forEachPage(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 9}
+	f.reindex()
+	f.free(100, &page{id: 12, overflow: 1})
+	f.free(101, &page{id: 6})
+
+	var got pgids
+	f.forEachPage(func(id pgid) bool {
+		got = append(got, id)
+		return true
+	})
+	sort.Sort(got)
+	if exp := f.all(); !reflect.DeepEqual(pgids(exp), got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+
+	var n int
+	f.forEachPage(func(id pgid) bool {
+		n++
+		return n < 4
+	})
+	if n != 4 {
+		t.Fatalf("exp=4; got=%v", n)
+	}
+}
+
+// Ensure that the digest depends only on the free pages.
+func TestFreelist_digest(t *testing.T) {
+	a := &freelist{ids: []pgid{3, 4, 9}, pending: map[txid][]pgid{100: {12}}}
+	b := &freelist{ids: []pgid{3, 4, 9}, pending: map[txid][]pgid{}}
+	if a.digest() != b.digest() {
+		t.Fatalf("digest mismatch: %x != %x", a.digest(), b.digest())
+	}
+
+	b.ids = []pgid{3, 4, 10}
+	if a.digest() == b.digest() {
+		t.Fatalf("unexpected digest match: %x", a.digest())
+	}
+}
+
+// Ensure that allocated ranges are reported between free pages.
+func TestFreelist_eachAllocatedRange(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 9}, pending: map[txid][]pgid{100: {5, 6}}}
+
+	var got [][2]uint64
+	fn := func(start pgid, size uint64) bool {
+		got = append(got, [2]uint64{uint64(start), size})
+		return true
+	}
+	f.eachAllocatedRange(12, false, fn)
+	if exp := [][2]uint64{{0, 3}, {5, 4}, {10, 2}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+
+	got = nil
+	f.eachAllocatedRange(12, true, fn)
+	if exp := [][2]uint64{{0, 3}, {7, 2}, {10, 2}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+
+	// Free runs at or past total end the walk.
+	got = nil
+	f.eachAllocatedRange(8, true, fn)
+	if exp := [][2]uint64{{0, 3}, {7, 1}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+
+	got = nil
+	f.eachAllocatedRange(12, false, func(start pgid, size uint64) bool {
+		fn(start, size)
+		return false
+	})
+	if exp := [][2]uint64{{0, 3}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+}
+
+// Ensure that release reclaims unused capacity when shrinking is enabled.
+func TestFreelist_release_shrink(t *testing.T) {
+	f := &freelist{ids: make([]pgid, 2, 100), pending: make(map[txid][]pgid)}
+	f.ids[0], f.ids[1] = 3, 4
+	f.release(100)
+	if cap(f.ids) != 100 {
+		t.Fatalf("unexpected cap: %d", cap(f.ids))
+	}
+
+	f.shrink = true
+	f.release(100)
+	if exp := []pgid{3, 4}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if cap(f.ids) != 2 {
+		t.Fatalf("unexpected cap: %d", cap(f.ids))
+	}
+}
+
+// Ensure that the page accounting adds up to the file size.
+func TestFreelist_accounting(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 9}
+	f.free(100, &page{id: 12, overflow: 1})
+
+	a, err := f.accounting(20)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := (freelistAccounting{Free: 3, Pending: 2, Allocated: 13, Total: 20}); a != exp {
+		t.Fatalf("exp=%+v; got=%+v", exp, a)
+	}
+
+	if _, err := f.accounting(13); err == nil || err.Error() != "pending page 13 beyond end of file: 13" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := f.accounting(9); err == nil || err.Error() != "free page 9 beyond end of file: 9" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that freelist stats describe the runs of free and pending pages.
+func TestFreelist_stats(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 9, 12, 13}
+	f.reindex()
+	f.free(100, &page{id: 20, overflow: 1})
+	f.free(101, &page{id: 22})
+	f.free(101, &page{id: 30})
+
+	exp := freelistStats{FreePages: 6, PendingPages: 4, FreeRuns: 3, PendingRuns: 2, LargestRun: 3, SmallestRun: 1}
+	if s := f.stats(); s != exp {
+		t.Fatalf("exp=%+v; got=%+v", exp, s)
+	}
+	if s := newFreelist().stats(); s != (freelistStats{}) {
+		t.Fatalf("exp=%+v; got=%+v", freelistStats{}, s)
+	}
+}
+
+// Ensure that stats can be read from another goroutine while the freelist
+// is being updated.
+func TestFreelist_concurrentStats(t *testing.T) {
+	f := newFreelist()
+	f.mu = &sync.RWMutex{}
+	f.ids = fragmentedPgids(100, 1, 8)
+	f.reindex()
+	total := f.free_count()
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if s := f.concurrentStats(); s.FreePages+s.PendingPages > total {
+				errc <- fmt.Errorf("too many pages: %+v", s)
+				return
+			}
+		}
+	}()
+
+	// The hooks run without the lock held so they may read stats too.
+	f.onAllocate = func(start pgid, n int) { f.concurrentStats() }
+	f.onFree = func(txid txid, start pgid, n int) { f.concurrentStats() }
+
+	for tx := txid(1); tx < 1000; tx++ {
+		if id := f.allocate(1); id != 0 {
+			f.free(tx, &page{id: id})
+		}
+		if ids := f.allocateN(2); ids != nil {
+			f.free(tx, &page{id: ids[0]})
+			f.freePendingUnassigned(&page{id: ids[1]})
+			f.assignPending(tx)
+		}
+		if id := f.allocateHigh(1); id != 0 {
+			f.free(tx, &page{id: id})
+			f.unfree(tx, &page{id: id})
+			f.free(tx, &page{id: id})
+		}
+		if r, _ := f.reserve(1); r != nil {
+			f.cancelReservation(r)
+		}
+		f.release(tx - 1)
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that fragmentation reflects the share of pages outside the longest run.
+func TestFreelist_fragmentation(t *testing.T) {
+	f := &freelist{}
+	if v := f.fragmentation(); v != 0 {
+		t.Fatalf("exp=0; got=%v", v)
+	}
+	f.ids = []pgid{3, 4, 5, 6}
+	if v := f.fragmentation(); v != 0 {
+		t.Fatalf("exp=0; got=%v", v)
+	}
+	f.ids, f.largest = []pgid{3, 4, 5, 9, 12, 14, 15, 20}, 0
+	if v := f.fragmentation(); v != 0.625 {
+		t.Fatalf("exp=0.625; got=%v", v)
+	}
+}
+
+// Ensure that the run histogram counts runs by power-of-two size class.
+func TestFreelist_runHistogram(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 9, 12, 14, 15, 20, 21, 22, 23}
+	f.reindex()
+	f.free(100, &page{id: 10, overflow: 1})
+
+	if exp, h := map[int]int{1: 2, 2: 2, 4: 1}, f.runHistogram(false); !reflect.DeepEqual(exp, h) {
+		t.Fatalf("exp=%v; got=%v", exp, h)
+	}
+	if exp, h := map[int]int{2: 2, 4: 2}, f.runHistogram(true); !reflect.DeepEqual(exp, h) {
+		t.Fatalf("exp=%v; got=%v", exp, h)
+	}
+}
+
+// Ensure that the observer hooks see each allocation and free.
+func TestFreelist_observers(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5}
+	f.reindex()
+	var events []string
+	f.onAllocate = func(start pgid, n int) { events = append(events, fmt.Sprintf("allocate %d %d", start, n)) }
+	f.onFree = func(txid txid, start pgid, n int) {
+		events = append(events, fmt.Sprintf("free %d %d %d", txid, start, n))
+	}
+
+	f.allocate(2)
+	f.allocate(2)
+	f.free(100, &page{id: 8, overflow: 2})
+	if exp := []string{"allocate 3 2", "free 100 8 3"}; !reflect.DeepEqual(exp, events) {
+		t.Fatalf("exp=%v; got=%v", exp, events)
+	}
+
+	// Every allocation method reports the blocks it takes.
+	events = nil
+	f.ids = []pgid{3, 4, 5, 6, 7, 9, 10, 11, 12}
+	f.reindex()
+	f.allocateAt(4, 1)
+	f.allocateN(2)
+	f.allocateHigh(2)
+	f.allocateBounded(1, 1)
+	exp := []string{"allocate 4 1", "allocate 3 1", "allocate 5 1", "allocate 11 2", "allocate 6 1"}
+	if !reflect.DeepEqual(exp, events) {
+		t.Fatalf("exp=%v; got=%v", exp, events)
+	}
+}
+
+// Ensure that the highest allocated page is remembered after it is freed.
+func TestFreelist_highest(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 9, 10, 11}
+	f.reindex()
+	f.allocate(3)
+	f.allocate(2)
+	if f.highest != 11 {
+		t.Fatalf("exp=11; got=%v", f.highest)
+	}
+
+	f.free(100, &page{id: 9, overflow: 2})
+	f.release(100)
+	f.allocate(1)
+	if f.highest != 11 {
+		t.Fatalf("exp=11; got=%v", f.highest)
+	}
+}
+
+// Ensure that the oldest pending transaction and its page count are reported.
+func TestFreelist_oldestPending(t *testing.T) {
+	f := newFreelist()
+	if _, _, ok := f.oldestPending(); ok {
+		t.Fatal("expected no pending transaction")
+	}
+
+	f.freePendingUnassigned(&page{id: 3})
+	if _, _, ok := f.oldestPending(); ok {
+		t.Fatal("expected unassigned pages to be ignored")
+	}
+
+	f.free(102, &page{id: 5})
+	f.free(100, &page{id: 7, overflow: 2})
+	f.free(101, &page{id: 12})
+	if tid, pages, ok := f.oldestPending(); !ok || tid != 100 || pages != 3 {
+		t.Fatalf("exp=100,3,true; got=%v,%v,%v", tid, pages, ok)
+	}
+}
+
+// Ensure that a freelist dump lists runs of free and pending pages.
+func TestFreelist_dump(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 9, 12, 13}
+	f.reindex()
+	f.free(101, &page{id: 30})
+	f.free(101, &page{id: 22})
+	f.free(100, &page{id: 20, overflow: 1})
+	f.freePendingUnassigned(&page{id: 40})
+
+	var buf bytes.Buffer
+	if err := f.dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exp := "free: [3,5] [9,9] [12,13]\n" +
+		"pending 100: [20,21]\n" +
+		"pending 101: [22,22] [30,30]\n" +
+		"pending unassigned: [40,40]\n" +
+		"total: 6 free, 5 pending\n"
+	if buf.String() != exp {
+		t.Fatalf("exp=%q; got=%q", exp, buf.String())
+	}
+}
+
+// Ensure that pages missing from both the tree and the freelist are reported.
+func TestFreelist_leaked(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4}
+	f.reindex()
+	f.free(100, &page{id: 7})
+
+	if exp, got := (pgids{6, 11}), f.leaked(12, pgids{2, 5, 8, 9, 10}); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+	if got := f.leaked(12, pgids{2, 5, 6, 8, 9, 10, 11}); len(got) != 0 {
+		t.Fatalf("unexpected leaks: %v", got)
+	}
+}
+
 // Ensure that a freelist can find contiguous blocks of pages.
 func TestFreelist_allocate(t *testing.T) {
 	f := &freelist{ids: []pgid{3, 4, 5, 6, 7, 9, 12, 13, 18}}
@@ -86,73 +637,1668 @@ func TestFreelist_allocate(t *testing.T) {
 	}
 }
 
-// Ensure that a freelist can deserialize from a freelist page.
-func TestFreelist_read(t *testing.T) {
-	// Create a page.
-	var buf [4096]byte
-	page := (*page)(unsafe.Pointer(&buf[0]))
-	page.flags = freelistPageFlag
-	page.count = 2
+// Ensure that the best-fit allocator prefers an exact fit and otherwise the
+// smallest block that is large enough.
+func TestFreelist_allocate_bestFit(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 10, 11, 20, 21, 22}}
+	f.alloc = bestFitAllocator{}
+	if id := f.allocate(2); id != 10 {
+		t.Fatalf("exp=10; got=%v", id)
+	}
+	if id := f.allocate(2); id != 20 {
+		t.Fatalf("exp=20; got=%v", id)
+	}
+	if exp := []pgid{3, 4, 5, 6, 22}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
 
-	// Insert 2 page ids.
-	ids := (*[3]pgid)(unsafe.Pointer(&page.ptr))
-	ids[0] = 23
-	ids[1] = 50
+// lastFitAllocator picks the last contiguous block large enough.
+type lastFitAllocator struct{}
 
-	// Deserialize page into a freelist.
-	f := newFreelist()
-	f.read(page)
+func (lastFitAllocator) pick(f *freelist, n int) int {
+	idx := -1
+	f.eachRun(func(i, size int) bool {
+		if size >= n {
+			idx = i
+		}
+		return true
+	})
+	return idx
+}
 
-	// Ensure that there are two page ids in the freelist.
-	if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.ids) {
+// Ensure that allocate delegates block selection to the freelist's allocator.
+func TestFreelist_allocate_allocator(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 10, 11, 20, 21, 22}}
+	f.alloc = firstFitAllocator{}
+	if id := f.allocate(2); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	f.alloc = lastFitAllocator{}
+	if id := f.allocate(2); id != 20 {
+		t.Fatalf("exp=20; got=%v", id)
+	}
+	f.alloc = bestFitAllocator{}
+	if id := f.allocate(1); id != 22 {
+		t.Fatalf("exp=22; got=%v", id)
+	}
+	if exp := []pgid{5, 6, 10, 11}; !reflect.DeepEqual(exp, f.ids) {
 		t.Fatalf("exp=%v; got=%v", exp, f.ids)
 	}
 }
 
-// Ensure that a freelist can serialize into a freelist page.
-func TestFreelist_write(t *testing.T) {
-	// Create a freelist and write it to a page.
-	var buf [4096]byte
-	f := &freelist{ids: []pgid{12, 39}, pending: make(map[txid][]pgid)}
-	f.pending[100] = []pgid{28, 11}
-	f.pending[101] = []pgid{3}
-	p := (*page)(unsafe.Pointer(&buf[0]))
-	if err := f.write(p); err != nil {
-		t.Fatal(err)
+// Ensure that next-fit allocation resumes after the previous allocation and
+// wraps around.
+func TestFreelist_allocate_nextFit(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 6, 10, 11, 20}
+	f.reindex()
+	f.alloc = nextFitAllocator{}
+	for _, exp := range []pgid{3, 5, 10} {
+		if id := f.allocate(2); id != exp {
+			t.Fatalf("exp=%v; got=%v", exp, id)
+		}
+	}
+	if id := f.allocate(2); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
 	}
 
-	// Read the page back out.
-	f2 := newFreelist()
-	f2.read(p)
-
-	// Ensure that the freelist is correct.
-	// All pages should be present and in reverse order.
-	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.ids) {
-		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
+	// Freed pages behind the cursor are found after wrapping around.
+	f.free(100, &page{id: 5, overflow: 1})
+	f.release(100)
+	if id := f.allocate(1); id != 20 {
+		t.Fatalf("exp=20; got=%v", id)
+	}
+	if id := f.allocate(1); id != 5 {
+		t.Fatalf("exp=5; got=%v", id)
+	}
+	if exp := []pgid{6}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
 	}
 }
 
-func Benchmark_FreelistRelease10K(b *testing.B)    { benchmark_FreelistRelease(b, 10000) }
-func Benchmark_FreelistRelease100K(b *testing.B)   { benchmark_FreelistRelease(b, 100000) }
-func Benchmark_FreelistRelease1000K(b *testing.B)  { benchmark_FreelistRelease(b, 1000000) }
-func Benchmark_FreelistRelease10000K(b *testing.B) { benchmark_FreelistRelease(b, 10000000) }
+// panicAllocator fails the test if allocate asks it to pick a block.
+type panicAllocator struct{}
 
-func benchmark_FreelistRelease(b *testing.B, size int) {
-	ids := randomPgids(size)
-	pending := randomPgids(len(ids) / 400)
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		f := &freelist{ids: ids, pending: map[txid][]pgid{1: pending}}
-		f.release(1)
-	}
-}
+func (panicAllocator) pick(f *freelist, n int) int { panic("unexpected scan") }
 
-func randomPgids(n int) []pgid {
-	rand.Seed(42)
-	pgids := make(pgids, n)
-	for i := range pgids {
-		pgids[i] = pgid(rand.Int63())
+// Ensure that the longest free run is cached until the ids change and that
+// allocate skips the scan when it is too short.
+func TestFreelist_largestFree(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 8, 9, 10}
+	f.reindex()
+	if n := f.largestFree(); n != 3 {
+		t.Fatalf("exp=3; got=%v", n)
+	}
+
+	f.alloc = panicAllocator{}
+	if id := f.allocate(4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+
+	f.alloc = nil
+	if id := f.allocate(2); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	} else if n := f.largestFree(); n != 3 {
+		t.Fatalf("exp=3; got=%v", n)
+	}
+	if id := f.allocate(3); id != 8 {
+		t.Fatalf("exp=8; got=%v", id)
+	} else if n := f.largestFree(); n != 0 {
+		t.Fatalf("exp=0; got=%v", n)
+	}
+
+	f.free(100, &page{id: 6, overflow: 1})
+	f.release(100)
+	if n := f.largestFree(); n != 2 {
+		t.Fatalf("exp=2; got=%v", n)
+	}
+}
+
+// Ensure that a failed allocate fills in the longest free run and that taking
+// from a shorter run keeps it.
+func TestFreelist_largestFree_allocate(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 5, 6, 7, 10, 11}
+	f.reindex()
+	if id := f.allocate(4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	} else if f.largest != 3 {
+		t.Fatalf("exp=3; got=%v", f.largest)
+	}
+
+	if id := f.allocate(1); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	} else if f.largest != 3 {
+		t.Fatalf("exp=3; got=%v", f.largest)
+	}
+	f.alloc = panicAllocator{}
+	if id := f.allocate(4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+
+	f.alloc = nil
+	if id := f.allocate(3); id != 5 {
+		t.Fatalf("exp=5; got=%v", id)
+	} else if f.largest != 0 {
+		t.Fatalf("exp=0; got=%v", f.largest)
+	}
+}
+
+// Ensure that free runs can be walked with and without pending pages.
+func TestFreelist_forEachSpan(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 9, 12}
+	f.reindex()
+	f.free(100, &page{id: 5, overflow: 1})
+	f.free(101, &page{id: 10})
+
+	collect := func(pending bool, limit int) []pgid {
+		var got []pgid
+		f.forEachSpan(pending, func(start pgid, n int) bool {
+			got = append(got, start, pgid(n))
+			return len(got) < 2*limit
+		})
+		return got
+	}
+	if exp, got := []pgid{3, 2, 9, 1, 12, 1}, collect(false, 10); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+	if exp, got := []pgid{3, 4, 9, 2, 12, 1}, collect(true, 10); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+	if exp, got := []pgid{3, 4}, collect(true, 1); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+}
+
+// Ensure that verify reports broken freelist invariants.
+func TestFreelist_verify(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 9}
+	f.reindex()
+	f.free(100, &page{id: 5, overflow: 1})
+	f.free(101, &page{id: 12})
+	if err := f.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.ids = []pgid{3, 9, 4}
+	if err := f.verify(); err == nil || err.Error() != "free page ids out of order at index 2: 9 >= 4" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.ids = []pgid{3, 4, 6}
+	if err := f.verify(); err == nil || err.Error() != "page 6 both free and pending in tx 100" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.ids = []pgid{3, 4, 9}
+	delete(f.cache, 12)
+	if err := f.verify(); err == nil || err.Error() != "free page cache has 5 pages, expected 6" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a checked allocation tells fragmentation apart from running
+// out of free pages.
+func TestFreelist_allocateChecked(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 5, 6, 8}}
+	if id, err := f.allocateChecked(2); err != nil || id != 5 {
+		t.Fatalf("exp=5,nil; got=%v,%v", id, err)
+	}
+	if id, err := f.allocateChecked(2); err != errFragmented || id != 0 {
+		t.Fatalf("exp=0,%v; got=%v,%v", errFragmented, id, err)
+	}
+	if id, err := f.allocateChecked(3); err != errNoSpace || id != 0 {
+		t.Fatalf("exp=0,%v; got=%v,%v", errNoSpace, id, err)
+	}
+
+	// Both reasons still match the common error.
+	for _, err := range []error{errFragmented, errNoSpace} {
+		if !errors.Is(err, errNoContiguousSpace) {
+			t.Fatalf("%v does not match %v", err, errNoContiguousSpace)
+		}
+	}
+	if errors.Is(errFragmented, errNoSpace) || errors.Is(errNoSpace, errFragmented) {
+		t.Fatal("reasons should not match each other")
+	}
+}
+
+// Ensure that every allocated block is passed to the scrub callback.
+func TestFreelist_allocate_scrub(t *testing.T) {
+	var got [][2]int
+	f := &freelist{ids: []pgid{3, 4, 5, 9}}
+	f.scrub = func(start pgid, n int) { got = append(got, [2]int{int(start), n}) }
+	f.allocate(2)
+	f.allocateRange(1, 5)
+	f.allocate(1)
+	if exp := [][2]int{{3, 2}, {5, 1}, {9, 1}}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+}
+
+// Ensure that first-fit skips runs it already found too small, and rescans
+// them once pages are released.
+func TestFreelist_allocate_scanResume(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 5, 7, 8, 9, 10, 12}
+	if id := f.allocate(2); id != 7 {
+		t.Fatalf("exp=7; got=%v", id)
+	} else if f.scanFrom != 7 || f.scanMin != 2 {
+		t.Fatalf("unexpected cursor: %v,%v", f.scanFrom, f.scanMin)
+	}
+	if id := f.allocate(2); id != 9 {
+		t.Fatalf("exp=9; got=%v", id)
+	}
+	if id := f.allocate(1); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+
+	// Releasing a page next to 5 makes a low run large enough again.
+	f.free(100, &page{id: 4})
+	f.release(100)
+	if id := f.allocate(2); id != 4 {
+		t.Fatalf("exp=4; got=%v", id)
+	}
+	if exp := []pgid{12}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a bounded allocation gives up after scanning too many runs.
+func TestFreelist_allocateBounded(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 5, 7, 9, 10, 11}}
+	if id, ok := f.allocateBounded(3, 3); ok || id != 0 {
+		t.Fatalf("exp=0,false; got=%v,%v", id, ok)
+	}
+	if id, ok := f.allocateBounded(3, 4); !ok || id != 9 {
+		t.Fatalf("exp=9,true; got=%v,%v", id, ok)
+	}
+	if id, ok := f.allocateBounded(2, 10); ok || id != 0 {
+		t.Fatalf("exp=0,false; got=%v,%v", id, ok)
+	}
+	if exp := []pgid{3, 5, 7}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that allocating by overflow count allocates overflow+1 pages.
+func TestFreelist_allocateOverflow(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 5, 6, 7, 8}}
+	if id := int(f.allocateOverflow(0)); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if id := int(f.allocateOverflow(3)); id != 5 {
+		t.Fatalf("exp=5; got=%v", id)
+	}
+	if exp := []pgid{}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that reserved pages can be committed or handed back.
+func TestFreelist_reserve(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 9}
+	f.reindex()
+
+	r, id := f.reserve(2)
+	if id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	} else if f.freed(3) || f.freed(4) {
+		t.Fatal("expected reserved pages to be unavailable")
+	}
+	f.cancelReservation(r)
+	if exp := []pgid{3, 4, 5, 9}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if !f.freed(3) || !f.freed(4) {
+		t.Fatal("expected cancelled pages to be free")
+	}
+
+	r, id = f.reserve(3)
+	if id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	f.commitReservation(r)
+	if exp := []pgid{9}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+
+	if r, id := f.reserve(2); r != nil || id != 0 {
+		t.Fatalf("exp=nil,0; got=%v,%v", r, id)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	f.cancelReservation(r)
+}
+
+// Ensure that cancelling a reservation whose pages a reload already restored panics.
+func TestFreelist_cancelReservation_reload(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5}
+	f.reindex()
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := f.reserve(2)
+	f.reload(p)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		} else if exp := []pgid{3, 4, 5}; !reflect.DeepEqual(exp, f.ids) {
+			t.Fatalf("exp=%v; got=%v", exp, f.ids)
+		}
+	}()
+	f.cancelReservation(r)
+}
+
+// Ensure that a recorded trace replays onto a fresh freelist.
+func TestFreelist_replayTrace(t *testing.T) {
+	var buf bytes.Buffer
+	var page0 [4096]byte
+	p := (*page)(unsafe.Pointer(&page0[0]))
+	f := newFreelist()
+	f.ids = []pgid{20, 21}
+	f.free(99, &page{id: 30})
+	f.reindex()
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f.startTrace(&buf)
+	f.free(100, &page{id: 3, overflow: 2})
+	f.free(100, &page{id: 9})
+	f.release(100)
+	if id := f.allocate(3); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if !f.allocateAt(21, 1) {
+		t.Fatal("expected allocateAt to succeed")
+	}
+	f.free(101, &page{id: 12})
+	f.rollback(101)
+	f.reload(p)
+
+	exp := "init 20 21\npending 99 30\nfree 100 3 2\nfree 100 9 0\nrelease 100\ntake 3 3\ntake 21 1\n" +
+		"free 101 12 0\nrollback 101\nreload 20 21 30\n"
+	if buf.String() != exp {
+		t.Fatalf("unexpected trace: %q", buf.String())
+	}
+
+	f2 := newFreelist()
+	if err := f2.replayTrace(strings.NewReader(exp)); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(f.ids, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", f.ids, f2.ids)
+	} else if !reflect.DeepEqual(f.pending, f2.pending) {
+		t.Fatalf("exp=%v; got=%v", f.pending, f2.pending)
+	} else if err := f2.verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	f3 := newFreelist()
+	err := f3.replayTrace(strings.NewReader("free 100 3 2\nrelease 100\ntake 4 3\n"))
+	if err == nil || err.Error() != "trace line 3: take: 3 pages at 4 are not free" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := f3.replayTrace(strings.NewReader("grow 10\n")); err == nil || err.Error() != `trace line 1: unknown operation "grow"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := f3.replayTrace(strings.NewReader("release\n")); err == nil || err.Error() != "trace line 1: release: expected 1 arguments, got 0" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a rolled-back transaction's allocations replay through reload.
+func TestFreelist_replayTrace_rollback(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	f := newFreelist()
+	f.ids = []pgid{3, 4}
+	f.reindex()
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	var trace bytes.Buffer
+	f.startTrace(&trace)
+	for i := 0; i < 2; i++ {
+		if id := f.allocate(1); id != 3 {
+			t.Fatalf("exp=3; got=%v", id)
+		}
+		f.rollback(10)
+		f.reload(p)
+	}
+
+	f2 := newFreelist()
+	if err := f2.replayTrace(&trace); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(f.ids, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", f.ids, f2.ids)
+	}
+}
+
+// Ensure that a range allocation takes as much of a block as allowed.
+func TestFreelist_allocateRange(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 5, 6, 7, 8, 12, 13}}
+	if id, n := f.allocateRange(2, 3); id != 5 || n != 3 {
+		t.Fatalf("exp=5,3; got=%v,%v", id, n)
+	}
+	if id, n := f.allocateRange(1, 4); id != 3 || n != 1 {
+		t.Fatalf("exp=3,1; got=%v,%v", id, n)
+	}
+	if id, n := f.allocateRange(3, 4); id != 0 || n != 0 {
+		t.Fatalf("exp=0,0; got=%v,%v", id, n)
+	}
+	if id, n := f.allocateRange(2, 4); id != 12 || n != 2 {
+		t.Fatalf("exp=12,2; got=%v,%v", id, n)
+	}
+	if exp := []pgid{8}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a rejected run is skipped in favor of the next one that fits.
+func TestFreelist_allocateFunc(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 6, 9, 10, 11}}
+	var offered []pgid
+	id := f.allocateFunc(2, func(start pgid, size int) bool {
+		offered = append(offered, start)
+		return start != 3
+	})
+	if id != 9 {
+		t.Fatalf("exp=9; got=%v", id)
+	} else if exp := []pgid{3, 9}; !reflect.DeepEqual(exp, offered) {
+		t.Fatalf("exp=%v; got=%v", exp, offered)
+	}
+
+	if id := f.allocateFunc(1, func(pgid, int) bool { return false }); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{3, 4, 6, 11}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a batch allocation gathers pages across runs.
+func TestFreelist_allocateN(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 7, 9, 10, 11}
+	f.reindex()
+	if ids := f.allocateN(7); ids != nil {
+		t.Fatalf("exp=nil; got=%v", ids)
+	}
+	if exp, ids := []pgid{3, 4, 7, 9}, f.allocateN(4); !reflect.DeepEqual(exp, ids) {
+		t.Fatalf("exp=%v; got=%v", exp, ids)
+	}
+	if exp := []pgid{10, 11}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+	if f.cache[9] || !f.cache[10] {
+		t.Fatalf("unexpected cache: %v", f.cache)
+	}
+}
+
+// Ensure that allocations near a hint pick the closest large enough block.
+func TestFreelist_allocateNear(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 10, 11, 14, 15, 20, 21, 30}}
+	if id := f.allocateNear(2, 12); id != 14 {
+		t.Fatalf("exp=14; got=%v", id)
+	}
+	if id := f.allocateNear(2, 13); id != 10 {
+		t.Fatalf("exp=10; got=%v", id)
+	}
+	if id := f.allocateNear(2, 40); id != 20 {
+		t.Fatalf("exp=20; got=%v", id)
+	}
+	if id := f.allocateNear(2, 0); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if id := f.allocateNear(2, 30); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{30}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that allocateNear takes a block from the middle of a run that
+// contains hint.
+func TestFreelist_allocateNear_insideRun(t *testing.T) {
+	f := &freelist{}
+	for id := pgid(2); id <= 1000; id++ {
+		f.ids = append(f.ids, id)
+	}
+	if id := f.allocateNear(10, 500); id != 500 {
+		t.Fatalf("exp=500; got=%v", id)
+	}
+	if id := f.allocateNear(3, 508); id != 510 {
+		t.Fatalf("exp=510; got=%v", id)
+	}
+	if id := f.allocateNear(5, 999); id != 996 {
+		t.Fatalf("exp=996; got=%v", id)
+	}
+	if id := f.allocateNear(4, 2000); id != 992 {
+		t.Fatalf("exp=992; got=%v", id)
+	}
+	if n := len(f.ids); n != 999-22 {
+		t.Fatalf("exp=%v; got=%v", 999-22, n)
+	}
+}
+
+// Ensure that high allocations come from the end of the highest fitting block.
+func TestFreelist_allocateHigh(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 10, 11, 12, 20}}
+	if id := f.allocateHigh(2); id != 11 {
+		t.Fatalf("exp=11; got=%v", id)
+	}
+	if id := f.allocateHigh(1); id != 20 {
+		t.Fatalf("exp=20; got=%v", id)
+	}
+	if id := f.allocateHigh(3); id != 4 {
+		t.Fatalf("exp=4; got=%v", id)
+	}
+	if id := f.allocateHigh(2); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{3, 10}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a specific range can be allocated only when it is entirely free.
+func TestFreelist_allocateAt(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 9, 10}}
+	if f.allocateAt(5, 3) {
+		t.Fatal("expected allocation across a gap to fail")
+	}
+	if f.allocateAt(7, 1) {
+		t.Fatal("expected allocation of a used page to fail")
+	}
+	if !f.allocateAt(4, 2) {
+		t.Fatal("expected allocation of free range to succeed")
+	}
+	if !f.allocateAt(10, 1) {
+		t.Fatal("expected allocation of last page to succeed")
+	}
+	if exp := []pgid{3, 6, 9}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a specific range overlapping pending pages cannot be allocated.
+func TestFreelist_allocateAt_pending(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 7}
+	f.reindex()
+	f.free(100, &page{id: 5, overflow: 1})
+	if f.allocateAt(3, 4) {
+		t.Fatal("expected allocation over pending pages to fail")
+	}
+	if !f.allocateAt(3, 2) {
+		t.Fatal("expected allocation of free range to succeed")
+	}
+	if exp := []pgid{7}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if !f.cache[5] || !f.cache[6] {
+		t.Fatal("expected pending pages to stay cached")
+	}
+}
+
+// Ensure that aligned allocations start on a multiple of the alignment.
+func TestFreelist_allocateAligned(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 7, 9, 10, 11, 13, 14, 15, 16, 17, 18}}
+	if id := f.allocateAligned(3, 4); id != 4 {
+		t.Fatalf("exp=4; got=%v", id)
+	}
+	if id := f.allocateAligned(2, 4); id != 16 {
+		t.Fatalf("exp=16; got=%v", id)
+	}
+	if id := f.allocateAligned(2, 8); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{3, 7, 9, 10, 11, 13, 14, 15, 18}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that block-aligned allocations never cross a block boundary.
+func TestFreelist_allocateBlockAligned(t *testing.T) {
+	f := &freelist{ids: []pgid{3, 4, 5, 6, 7, 10, 11, 12, 13, 14, 15, 16, 17}}
+	if id := f.allocateBlockAligned(2, 4); id != 4 {
+		t.Fatalf("exp=4; got=%v", id)
+	}
+	if id := f.allocateBlockAligned(8, 4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if id := f.allocateBlockAligned(4, 4); id != 12 {
+		t.Fatalf("exp=12; got=%v", id)
+	}
+	if id := f.allocateBlockAligned(3, 4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if id := f.allocateBlockAligned(6, 4); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if exp := []pgid{3, 6, 7, 10, 11, 16, 17}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that allocations are refused once a class is over its quota.
+func TestFreelist_allocateWithQuota(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 6, 7, 8}
+	q := &quota{limits: map[int]int{1: 3}}
+	if id := f.allocateWithQuota(2, 1, q); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if id := f.allocateWithQuota(2, 1, q); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if id := f.allocateWithQuota(2, 2, q); id != 5 {
+		t.Fatalf("exp=5; got=%v", id)
+	}
+
+	f.freeWithQuota(100, &page{id: 3, overflow: 1}, 1, q)
+	if q.used[1] != 0 {
+		t.Fatalf("exp=0; got=%v", q.used[1])
+	}
+	if id := f.allocateWithQuota(2, 1, q); id != 7 {
+		t.Fatalf("exp=7; got=%v", id)
+	}
+}
+
+// Ensure that a freelist can deserialize from a freelist page.
+func TestFreelist_read(t *testing.T) {
+	// Create a page.
+	var buf [4096]byte
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = freelistPageFlag
+	page.count = 2
+
+	// Insert 2 page ids.
+	ids := (*[3]pgid)(unsafe.Pointer(&page.ptr))
+	ids[0] = 23
+	ids[1] = 50
+
+	// Deserialize page into a freelist.
+	f := newFreelist()
+	if err := f.read(page); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that there are two page ids in the freelist.
+	if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that reading a corrupt freelist page returns an error.
+func TestFreelist_read_corrupt(t *testing.T) {
+	var buf [4096]byte
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = freelistPageFlag
+	page.count = 3
+	ids := (*[3]pgid)(unsafe.Pointer(&page.ptr))
+	ids[0], ids[1], ids[2] = 50, 23, 50
+
+	f := newFreelist()
+	if err := f.read(page); err == nil || err.Error() != "duplicate freelist page id: 50" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ids[2] = 1
+	if err := f.read(page); err == nil || err.Error() != "invalid freelist page id: 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A count larger than the page can hold is rejected before any ids are read.
+	f.pageSize = 4096
+	page.count = 511
+	if err := f.read(page); err == nil || err.Error() != "freelist page 0: count 511 exceeds page capacity 510" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A maximal overflow does not wrap the capacity around, and the capacity
+	// never exceeds what can be addressed.
+	page.count, page.overflow = 0xFFFF, 0xFFFFFFFF
+	ids[0] = 1 << 40
+	if err := f.read(page); err == nil || err.Error() != fmt.Sprintf("freelist page 0: count 1099511627776 exceeds page capacity %d", maxAllocSize-1) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An overflow reaching the high water mark is rejected before the
+	// overflow pages are read.
+	f.highWater = 10
+	if err := f.read(page); err == nil || err.Error() != "freelist page 0: overflow 4294967295 reaches high water mark 10" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	page.count, page.overflow, f.highWater = 3, 0, 0
+	ids[0] = 50
+
+	// The per-id checks are skipped for trusted pages.
+	page.count = 3
+	f.trusted = true
+	if err := f.read(page); err != nil {
+		t.Fatal(err)
+	} else if exp := []pgid{1, 23, 50}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a written freelist page is checksummed and that pages without
+// a checksum can still be read.
+func TestFreelist_read_checksum(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{12, 39}}).write(p); err != nil {
+		t.Fatal(err)
+	} else if p.flags&freelistChecksumFlag == 0 {
+		t.Fatal("expected checksum flag")
+	}
+
+	ids := (*[3]pgid)(unsafe.Pointer(&p.ptr))
+	ids[1] = 40
+	f := newFreelist()
+	if err := f.read(p); err == nil || err.Error() != "freelist page 0: checksum mismatch" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p.flags &^= freelistChecksumFlag
+	if err := f.read(p); err != nil {
+		t.Fatal(err)
+	} else if exp := []pgid{12, 40}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that page ids can be streamed out of a freelist page.
+func TestFreelist_readEach(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{3, 7, 9}}).write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []pgid
+	f := newFreelist()
+	if err := f.readEach(p, func(id pgid) error { got = append(got, id); return nil }); err != nil {
+		t.Fatal(err)
+	} else if exp := []pgid{3, 7, 9}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	} else if len(f.ids) != 0 {
+		t.Fatalf("unexpected ids: %v", f.ids)
+	}
+
+	errStop := errors.New("stop")
+	got = nil
+	if err := f.readEach(p, func(id pgid) error { got = append(got, id); return errStop }); err != errStop {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := []pgid{3}; !reflect.DeepEqual(exp, got) {
+		t.Fatalf("exp=%v; got=%v", exp, got)
+	}
+}
+
+// Ensure that a strict read rejects pages that read would repair.
+func TestFreelist_readStrict(t *testing.T) {
+	var buf [4096]byte
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = freelistPageFlag
+	page.count = 2
+	ids := (*[3]pgid)(unsafe.Pointer(&page.ptr))
+
+	ids[0], ids[1] = 23, 50
+	f := newFreelist()
+	if err := f.readStrict(page); err != nil {
+		t.Fatal(err)
+	} else if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+
+	ids[0], ids[1] = 50, 23
+	if err := f.readStrict(page); err == nil || err.Error() != "freelist page ids out of order at index 1: 50 >= 23" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ids[0], ids[1] = 1, 23
+	if err := f.readStrict(page); err == nil || err.Error() != "invalid freelist page id at index 0: 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	page.flags = leafPageFlag
+	if err := f.readStrict(page); err == nil || err.Error() != "invalid freelist page: 0, page type is leaf" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that writing a freelist larger than the page limit fails.
+func TestFreelist_write_maxPages(t *testing.T) {
+	var buf [4096]byte
+	f := &freelist{ids: []pgid{12, 39}, pending: make(map[txid][]pgid), maxPages: 2}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.overflow = 1
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	p.overflow = 2
+	if err := f.write(p); err == nil || err.Error() != "freelist requires 3 pages, exceeding limit of 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a freelist with more than 64k ids round trips through a page.
+func TestFreelist_write_overflow(t *testing.T) {
+	f := &freelist{pending: make(map[txid][]pgid)}
+	for id := pgid(2); id < 0x10002; id++ {
+		f.ids = append(f.ids, id)
+	}
+	buf := make([]byte, f.size())
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := newFreelist()
+	f2.read(p)
+	if !reflect.DeepEqual(f.ids, f2.ids) {
+		t.Fatalf("mismatch: len(exp)=%d; len(got)=%d", len(f.ids), len(f2.ids))
+	}
+}
+
+// Ensure that a freelist can serialize into a freelist page.
+func TestFreelist_write(t *testing.T) {
+	// Create a freelist and write it to a page.
+	var buf [4096]byte
+	f := &freelist{ids: []pgid{12, 39}, pending: make(map[txid][]pgid)}
+	f.pending[100] = []pgid{28, 11}
+	f.pending[101] = []pgid{3}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the page back out.
+	f2 := newFreelist()
+	f2.read(p)
+
+	// Ensure that the freelist is correct.
+	// All pages should be present and in reverse order.
+	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
+	}
+}
+
+// Ensure that reload tolerates pending pages that are missing from the page.
+func TestFreelist_reload_pendingNotOnPage(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{5, 6}}).write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFreelist()
+	f.free(100, &page{id: 6})
+	f.free(100, &page{id: 20})
+	f.reload(p)
+	if exp := []pgid{5}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+	if !f.freed(20) {
+		t.Fatal("expected pending page 20 to remain freed")
+	}
+}
+
+var (
+	stressSeed  = flag.Int64("freelist.stress.seed", 0, "seed for TestFreelistStress")
+	stressOps   = flag.Int("freelist.stress.ops", 10000, "operations performed by TestFreelistStress")
+	stressMix   = flag.String("freelist.stress.mix", "4,4,1,1,1,1,1,1,1", "allocate,free,release,rollback,lagging release,write,reload,finish reservation,unfree weights for TestFreelistStress")
+	stressAlloc = flag.String("freelist.stress.alloc", "", "allocator used by TestFreelistStress: first, best or next; empty picks one from the seed")
+)
+
+// Ensure that random allocate/free/release/rollback/reload sequences agree
+// with a simple model of free, pending and allocated pages.
+func TestFreelistStress(t *testing.T) {
+	var weights [9]int
+	fields := strings.Split(*stressMix, ",")
+	if len(fields) != len(weights) {
+		t.Fatalf("invalid -freelist.stress.mix: want %d weights; got %d", len(weights), len(fields))
+	}
+	var total int
+	for i := range weights {
+		if _, err := fmt.Sscan(fields[i], &weights[i]); err != nil {
+			t.Fatalf("invalid -freelist.stress.mix: %s", err)
+		}
+		total += weights[i]
+		weights[i] = total
+	}
+	ops := *stressOps
+	if testing.Short() {
+		ops /= 10
+	}
+
+	allocators := map[string]allocator{"first": firstFitAllocator{}, "best": bestFitAllocator{}, "next": nextFitAllocator{}}
+	name := *stressAlloc
+	if name == "" {
+		name = []string{"first", "best", "next"}[uint64(*stressSeed)%3]
+	} else if allocators[name] == nil {
+		t.Fatalf("invalid -freelist.stress.alloc: %q", name)
+	}
+	t.Logf("seed=%d ops=%d mix=%s alloc=%s", *stressSeed, ops, *stressMix, name)
+
+	type alloc struct {
+		id pgid
+		n  int
+	}
+	type reserved struct {
+		r *reservation
+		a alloc
+	}
+	var (
+		rand      = rand.New(rand.NewSource(*stressSeed))
+		f         = newFreelist()
+		free      = make(map[pgid]bool)
+		pending   = make(map[txid][]alloc)
+		allocated []alloc
+		reserves  []reserved // outstanding reservations
+		high      = pgid(2)
+		tx        = txid(1)
+		watermark = txid(0)
+		written   *page         // last freelist page written
+		onPage    map[pgid]bool // model pages free or pending when it was written
+	)
+	f.alloc = allocators[name]
+
+	// pendingPages returns the model's pending pages.
+	pendingPages := func() map[pgid]bool {
+		m := make(map[pgid]bool)
+		for _, list := range pending {
+			for _, a := range list {
+				for i := a.id; i < a.id+pgid(a.n); i++ {
+					m[i] = true
+				}
+			}
+		}
+		return m
+	}
+
+	// release frees the model's pages pending for w or older.
+	release := func(w txid) {
+		f.release(w)
+		for tid, list := range pending {
+			if tid > w {
+				continue
+			}
+			for _, a := range list {
+				for i := a.id; i < a.id+pgid(a.n); i++ {
+					free[i] = true
+				}
+			}
+			delete(pending, tid)
+		}
+		watermark = w
+		tx++
+	}
+
+	for op := 0; op < ops; op++ {
+		r := rand.Intn(total)
+		switch {
+		case r < weights[0]:
+			// took checks a contiguous allocation of n pages at id against
+			// the model, growing the file instead if id is 0. Unless the
+			// method could fail with a block free, a failure means the model
+			// has no contiguous run of n free pages.
+			n := 1 + rand.Intn(4)
+			took := func(method string, id pgid, anyFit bool) pgid {
+				if id == 0 {
+					run := 0
+					for i := pgid(2); anyFit && i < high; i++ {
+						if run = run + 1; !free[i] {
+							run = 0
+						} else if run >= n {
+							t.Fatalf("op %d: %s(%d) failed but %d is free", op, method, n, i-pgid(n-1))
+						}
+					}
+					id, high = high, high+pgid(n)
+					return id
+				}
+				for i := id; i < id+pgid(n); i++ {
+					if !free[i] {
+						t.Fatalf("op %d: %s(%d) returned %d but page %d is not free", op, method, n, id, i)
+					}
+					delete(free, i)
+				}
+				return id
+			}
+
+			switch rand.Intn(6) {
+			case 0:
+				allocated = append(allocated, alloc{took("allocate", f.allocate(n), true), n})
+			case 1:
+				hint := 2 + pgid(rand.Int63n(int64(high)))
+				allocated = append(allocated, alloc{took("allocateNear", f.allocateNear(n, hint), true), n})
+			case 2:
+				allocated = append(allocated, alloc{took("allocateHigh", f.allocateHigh(n), true), n})
+			case 3:
+				// allocateAt succeeds exactly when the whole range is free.
+				start, exp := 2+pgid(rand.Int63n(int64(high))), true
+				for i := start; i < start+pgid(n); i++ {
+					exp = exp && free[i]
+				}
+				var id pgid
+				if ok := f.allocateAt(start, n); ok != exp {
+					t.Fatalf("op %d: allocateAt(%d, %d): exp %v; got %v", op, start, n, exp, ok)
+				} else if ok {
+					id = start
+				}
+				allocated = append(allocated, alloc{took("allocateAt", id, false), n})
+			case 4:
+				// allocateN takes the lowest free pages, or none if too few are free.
+				ids := f.allocateN(n)
+				if len(free) < n {
+					if ids != nil {
+						t.Fatalf("op %d: allocateN(%d) returned %v with %d free", op, n, ids, len(free))
+					}
+					continue
+				}
+				i := pgid(2)
+				for _, id := range ids {
+					for !free[i] {
+						i++
+					}
+					if id != i {
+						t.Fatalf("op %d: allocateN(%d) returned %d; exp %d", op, n, id, i)
+					}
+					delete(free, id)
+					allocated = append(allocated, alloc{id, 1})
+				}
+			default:
+				res, id := f.reserve(n)
+				if res == nil {
+					allocated = append(allocated, alloc{took("reserve", 0, true), n})
+				} else {
+					reserves = append(reserves, reserved{res, alloc{took("reserve", id, true), n}})
+				}
+			}
+
+		case r < weights[1]:
+			if len(allocated) == 0 {
+				continue
+			}
+			i := rand.Intn(len(allocated))
+			a := allocated[i]
+			allocated = append(allocated[:i], allocated[i+1:]...)
+			f.free(tx, &page{id: a.id, overflow: uint32(a.n - 1)})
+			pending[tx] = append(pending[tx], a)
+
+		case r < weights[2]:
+			release(tx)
+
+		case r < weights[3]:
+			f.rollback(tx)
+			allocated = append(allocated, pending[tx]...)
+			delete(pending, tx)
+			tx++
+
+		case r < weights[4]:
+			// A reader pins a watermark between the last one and now.
+			release(watermark + txid(rand.Int63n(int64(tx-watermark)+1)))
+
+		case r < weights[5]:
+			buf := make([]byte, f.size())
+			written = (*page)(unsafe.Pointer(&buf[0]))
+			if err := f.write(written); err != nil {
+				t.Fatalf("op %d: write: %s", op, err)
+			}
+			onPage = pendingPages()
+			for id := range free {
+				onPage[id] = true
+			}
+
+		case r < weights[6]:
+			if written == nil {
+				continue
+			}
+
+			// Reservations do not survive a reload, so commit them first.
+			for _, v := range reserves {
+				f.commitReservation(v.r)
+				allocated = append(allocated, v.a)
+			}
+			reserves = nil
+			f.reload(written)
+
+			// The page's pages that are not pending now become free. Free
+			// pages missing from the page and allocated pages on it swap.
+			inPending := pendingPages()
+			next := make(map[pgid]bool)
+			for id := range onPage {
+				if !inPending[id] {
+					next[id] = true
+				}
+			}
+			var kept []alloc
+			for _, a := range allocated {
+				start := a.id
+				for i := a.id; i <= a.id+pgid(a.n); i++ {
+					if i == a.id+pgid(a.n) || next[i] {
+						if i > start {
+							kept = append(kept, alloc{start, int(i - start)})
+						}
+						start = i + 1
+					}
+				}
+			}
+			for i := pgid(2); i < high; i++ {
+				if free[i] && !next[i] {
+					kept = append(kept, alloc{i, 1})
+				}
+			}
+			allocated, free = kept, next
+
+		case r < weights[7]:
+			if len(reserves) == 0 {
+				continue
+			}
+			i := rand.Intn(len(reserves))
+			v := reserves[i]
+			reserves = append(reserves[:i], reserves[i+1:]...)
+			if rand.Intn(2) == 0 {
+				f.cancelReservation(v.r)
+				for i := v.a.id; i < v.a.id+pgid(v.a.n); i++ {
+					free[i] = true
+				}
+			} else {
+				f.commitReservation(v.r)
+				allocated = append(allocated, v.a)
+			}
+
+		default:
+			var tids txids
+			for tid := range pending {
+				tids = append(tids, tid)
+			}
+			if len(tids) == 0 {
+				continue
+			}
+			sort.Sort(tids)
+			tid := tids[rand.Intn(len(tids))]
+			list := pending[tid]
+			i := rand.Intn(len(list))
+			a := list[i]
+
+			// Pages are only pending for the transaction that freed them.
+			if f.unfree(tid+1, &page{id: a.id, overflow: uint32(a.n - 1)}) {
+				t.Fatalf("op %d: unfree(%d, %d) succeeded for the wrong txid", op, tid+1, a.id)
+			}
+			if !f.unfree(tid, &page{id: a.id, overflow: uint32(a.n - 1)}) {
+				t.Fatalf("op %d: unfree(%d, %d) failed", op, tid, a.id)
+			}
+			if list = append(list[:i], list[i+1:]...); len(list) == 0 {
+				delete(pending, tid)
+			} else {
+				pending[tid] = list
+			}
+			allocated = append(allocated, a)
+		}
+
+		// Verify every page against the model.
+		var pendingN int
+		inPending := pendingPages()
+		for _, list := range pending {
+			for _, a := range list {
+				pendingN += a.n
+			}
+		}
+		for i := pgid(0); i < high; i++ {
+			if exp := free[i] || inPending[i]; f.freed(i) != exp {
+				t.Fatalf("op %d: page %d: exp freed=%v", op, i, exp)
+			}
+		}
+		for _, id := range f.ids {
+			if !free[id] {
+				t.Fatalf("op %d: page %d available but not free in model", op, id)
+			}
+		}
+		if cached := f.largest; cached != 0 {
+			f.largest = 0
+			if n := f.largestFree(); n != cached {
+				t.Fatalf("op %d: exp largest=%d; got=%d", op, n, cached)
+			}
+		}
+		if f.free_count() != len(free) {
+			t.Fatalf("op %d: exp free_count=%d; got=%d", op, len(free), f.free_count())
+		} else if f.pending_count() != pendingN {
+			t.Fatalf("op %d: exp pending_count=%d; got=%d", op, pendingN, f.pending_count())
+		}
+	}
+}
+
+// Ensure that reload without pending pages matches a plain read.
+func TestFreelist_reload_noPending(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{5, 6, 9}}).write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFreelist()
+	f.reload(p)
+	f2 := newFreelist()
+	f2.read(p)
+	if !reflect.DeepEqual(f, f2) {
+		t.Fatalf("exp=%+v; got=%+v", f2, f)
+	}
+}
+
+// Ensure that reload reports the available pages it added and removed.
+func TestFreelist_reload_changes(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{5, 6, 9}}).write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFreelist()
+	f.ids = []pgid{3, 5}
+	f.free(100, &page{id: 9})
+	added, removed, err := f.reload(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := (pgids{6}); !reflect.DeepEqual(exp, added) {
+		t.Fatalf("exp=%v; got=%v", exp, added)
+	} else if exp := (pgids{3}); !reflect.DeepEqual(exp, removed) {
+		t.Fatalf("exp=%v; got=%v", exp, removed)
+	}
+}
+
+// Ensure that reloading from a corrupt page returns an error and keeps the freelist.
+func TestFreelist_reload_corrupt(t *testing.T) {
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := (&freelist{ids: []pgid{5, 6, 9}}).write(p); err != nil {
+		t.Fatal(err)
+	}
+	p.overflow = 0xFFFFFFFF
+
+	f := newFreelist()
+	f.pageSize, f.highWater = 4096, 100
+	f.ids = []pgid{3, 5}
+	f.free(100, &page{id: 9})
+	f.reindex()
+	if _, _, err := f.reload(p); err == nil || err.Error() != "freelist page 0: overflow 4294967295 reaches high water mark 100" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if exp := []pgid{3, 5}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	} else if err := f.verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// freelistSnapshot is a plain view of a freelist's free and pending pages as
+// runs of contiguous page ids, keyed by txid for pending pages.
+type freelistSnapshot struct {
+	Free    []spanView
+	Pending map[uint64][]spanView
+}
+
+// spanView is a run of Size contiguous page ids beginning at Start.
+type spanView struct {
+	Start, Size uint64
+}
+
+// snapshot returns a copy of the freelist's state as runs of page ids.
+func (f *freelist) snapshot() freelistSnapshot {
+	s := freelistSnapshot{Free: viewSpans(f.ids), Pending: make(map[uint64][]spanView)}
+	for tid, ids := range f.pending {
+		a := make(pgids, len(ids))
+		copy(a, ids)
+		sort.Sort(a)
+		s.Pending[uint64(tid)] = viewSpans(a)
+	}
+	return s
+}
+
+// fromSnapshot returns a freelist holding the pages described by s.
+func fromSnapshot(s freelistSnapshot) *freelist {
+	f := newFreelist()
+	f.ids = viewIDs(s.Free)
+	for tid, spans := range s.Pending {
+		f.pending[txid(tid)] = viewIDs(spans)
+	}
+	f.reindex()
+	return f
+}
+
+// viewSpans converts a sorted list of page ids into runs.
+func viewSpans(ids []pgid) []spanView {
+	var a []spanView
+	pgids(ids).eachRun(func(i, n int) bool {
+		a = append(a, spanView{Start: uint64(ids[i]), Size: uint64(n)})
+		return true
+	})
+	return a
+}
+
+// viewIDs expands runs into a list of page ids.
+func viewIDs(spans []spanView) []pgid {
+	var a []pgid
+	for _, s := range spans {
+		for i := uint64(0); i < s.Size; i++ {
+			a = append(a, pgid(s.Start+i))
+		}
+	}
+	return a
+}
+
+// Ensure that a snapshot describes a freelist and can rebuild it.
+func TestFreelist_snapshot(t *testing.T) {
+	f := newFreelist()
+	f.ids = []pgid{3, 4, 5, 9}
+	f.free(100, &page{id: 13})
+	f.free(100, &page{id: 11, overflow: 1})
+
+	s := f.snapshot()
+	exp := freelistSnapshot{
+		Free:    []spanView{{Start: 3, Size: 3}, {Start: 9, Size: 1}},
+		Pending: map[uint64][]spanView{100: {{Start: 11, Size: 3}}},
+	}
+	if !reflect.DeepEqual(exp, s) {
+		t.Fatalf("exp=%+v; got=%+v", exp, s)
+	}
+
+	f2 := fromSnapshot(s)
+	if !reflect.DeepEqual(f.ids, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", f.ids, f2.ids)
+	} else if exp := []pgid{11, 12, 13}; !reflect.DeepEqual(exp, f2.pending[100]) {
+		t.Fatalf("exp=%v; got=%v", exp, f2.pending[100])
+	} else if !f2.freed(12) {
+		t.Fatal("expected pending page 12 to be freed")
+	}
+}
+
+func Benchmark_FreelistRelease10K(b *testing.B)    { benchmark_FreelistRelease(b, 10000) }
+func Benchmark_FreelistRelease100K(b *testing.B)   { benchmark_FreelistRelease(b, 100000) }
+func Benchmark_FreelistRelease1000K(b *testing.B)  { benchmark_FreelistRelease(b, 1000000) }
+func Benchmark_FreelistRelease10000K(b *testing.B) { benchmark_FreelistRelease(b, 10000000) }
+
+func benchmark_FreelistRelease(b *testing.B, size int) {
+	ids := randomPgids(size)
+	pending := randomPgids(len(ids) / 400)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := &freelist{ids: ids, pending: map[txid][]pgid{1: pending}}
+		f.release(1)
+	}
+}
+
+// Free and release one page per transaction, as a steady stream of small
+// write transactions does.
+func Benchmark_FreelistReleaseSteady(b *testing.B) {
+	f := newFreelist()
+	f.ids = fragmentedPgids(1000, 1, 16)
+	f.reindex()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx := txid(i + 1)
+		f.free(tx, &page{id: f.allocate(1)})
+		f.release(tx)
+	}
+}
+
+// Release while an old reader pins the pending pages of many transactions,
+// so no release frees anything.
+func Benchmark_FreelistReleasePinned(b *testing.B) {
+	f := newFreelist()
+	f.ids = fragmentedPgids(1000, 1, 16)
+	f.reindex()
+	for tx := txid(100); tx < 150; tx++ {
+		f.free(tx, &page{id: f.allocate(1)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.release(99)
+	}
+}
+
+// Reload a freelist page while transactions hold pending pages, as each
+// rolled-back write transaction does.
+func Benchmark_FreelistReload(b *testing.B) {
+	buf := make([]byte, 64*1024)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	f := newFreelist()
+	f.ids = fragmentedPgids(200, 1, 16)
+	f.reindex()
+	for tx := txid(1); tx <= 10; tx++ {
+		f.free(tx, &page{id: f.allocate(1)})
+	}
+	if err := f.write(p); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.reload(p)
+	}
+}
+
+// newArenaFreelist returns a freelist for a fresh file of total pages where
+// every page after the meta pages is free.
+func newArenaFreelist(total pgid) *freelist {
+	f := newFreelist()
+	for id := pgid(2); id < total; id++ {
+		f.ids = append(f.ids, id)
+	}
+	f.reindex()
+	return f
+}
+
+// allocateOrGrow allocates n pages from f, growing the file at *high like
+// DB.allocate does when no contiguous block is free. It reports whether the
+// file had to grow.
+func allocateOrGrow(f *freelist, high *pgid, n int) (pgid, bool) {
+	if id := f.allocate(n); id != 0 {
+		return id, false
+	}
+	id := *high
+	*high += pgid(n)
+	return id, true
+}
+
+// Ensure that an arena freelist is used up before the file grows.
+func TestFreelist_arena(t *testing.T) {
+	f, high := newArenaFreelist(10), pgid(10)
+	if id, grew := allocateOrGrow(f, &high, 5); id != 2 || grew {
+		t.Fatalf("exp=2,false; got=%v,%v", id, grew)
+	}
+	if id, grew := allocateOrGrow(f, &high, 4); id != 10 || !grew {
+		t.Fatalf("exp=10,true; got=%v,%v", id, grew)
+	}
+	if id, grew := allocateOrGrow(f, &high, 3); id != 7 || grew {
+		t.Fatalf("exp=7,false; got=%v,%v", id, grew)
+	}
+	if high != 14 {
+		t.Fatalf("exp=14; got=%v", high)
+	}
+}
+
+func Benchmark_FreelistArenaFill(b *testing.B) {
+	rand := rand.New(rand.NewSource(42))
+	for i := 0; i < b.N; i++ {
+		f, high := newArenaFreelist(10000), pgid(10000)
+		for tx := txid(1); tx < 100; tx++ {
+			for j := 0; j < 50; j++ {
+				n := 1 + rand.Intn(4)
+				id, _ := allocateOrGrow(f, &high, n)
+				if rand.Intn(2) == 0 {
+					f.free(tx, &page{id: id, overflow: uint32(n - 1)})
+				}
+			}
+			f.release(tx)
+		}
+	}
+}
+
+func Benchmark_FreelistChurnFirstFit(b *testing.B) {
+	benchmark_FreelistChurn(b, firstFitAllocator{})
+}
+
+func Benchmark_FreelistChurnNextFit(b *testing.B) {
+	benchmark_FreelistChurn(b, nextFitAllocator{})
+}
+
+// benchmark_FreelistChurn allocates and frees small blocks across many
+// transactions using the given allocator.
+func benchmark_FreelistChurn(b *testing.B, a allocator) {
+	rand := rand.New(rand.NewSource(42))
+	for i := 0; i < b.N; i++ {
+		f, high := newArenaFreelist(10000), pgid(10000)
+		f.alloc = a
+		for tx := txid(1); tx < 100; tx++ {
+			for j := 0; j < 50; j++ {
+				n := 1 + rand.Intn(4)
+				id, _ := allocateOrGrow(f, &high, n)
+				if rand.Intn(2) == 0 {
+					f.free(tx, &page{id: id, overflow: uint32(n - 1)})
+				}
+			}
+			f.release(tx)
+		}
+	}
+}
+
+func randomPgids(n int) []pgid {
+	rand.Seed(42)
+	pgids := make(pgids, n)
+	for i := range pgids {
+		pgids[i] = pgid(rand.Int63())
 	}
 	sort.Sort(pgids)
 	return pgids
 }
+
+func Benchmark_FreelistAllocateBigSpan1FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 1, 100000, 100000, 1)
+}
+
+func Benchmark_FreelistAllocateBigSpan1BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 1, 100000, 100000, 1)
+}
+
+func Benchmark_FreelistAllocateBigSpan16FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 1, 100000, 100000, 16)
+}
+
+func Benchmark_FreelistAllocateBigSpan16BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 1, 100000, 100000, 16)
+}
+
+func Benchmark_FreelistAllocateMedium1FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 1000, 16, 128, 1)
+}
+
+func Benchmark_FreelistAllocateMedium1BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 1000, 16, 128, 1)
+}
+
+func Benchmark_FreelistAllocateMedium16FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 1000, 16, 128, 16)
+}
+
+func Benchmark_FreelistAllocateMedium16BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 1000, 16, 128, 16)
+}
+
+func Benchmark_FreelistAllocateScraps1FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 10000, 1, 1, 1)
+}
+
+func Benchmark_FreelistAllocateScraps1BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 10000, 1, 1, 1)
+}
+
+func Benchmark_FreelistAllocateScraps2FirstFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, firstFitAllocator{}, 10000, 1, 1, 2)
+}
+
+func Benchmark_FreelistAllocateScraps2BestFit(b *testing.B) {
+	benchmark_FreelistAllocate(b, bestFitAllocator{}, 10000, 1, 1, 2)
+}
+
+func Benchmark_FreelistFree10K(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := newFreelist()
+		for id := pgid(2); id < 10002; id++ {
+			f.free(1, &page{id: id})
+		}
+	}
+}
+
+// Allocate pairs of pages from a run that sits behind thousands of
+// single-page scraps.
+func Benchmark_FreelistAllocateFillThenAllocate(b *testing.B) {
+	ids := fragmentedPgids(10000, 1, 1)
+	for id, n := ids[len(ids)-1]+2, 0; n < 2000; id, n = id+1, n+1 {
+		ids = append(ids, id)
+	}
+	f := &freelist{ids: make([]pgid, len(ids))}
+	copy(f.ids, ids)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if f.allocate(2) == 0 {
+			b.StopTimer()
+			f.ids = append(f.ids[:0], ids...)
+			f.scanFrom, f.largest = 0, 0
+			b.StartTimer()
+		}
+	}
+}
+
+// benchmark_FreelistAllocate allocates n pages at a time from a fragmented
+// freelist using the given allocator.
+func benchmark_FreelistAllocate(b *testing.B, a allocator, runs, minSize, maxSize, n int) {
+	ids := fragmentedPgids(runs, minSize, maxSize)
+	f := &freelist{ids: make([]pgid, len(ids)), alloc: a}
+	copy(f.ids, ids)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Refill the freelist once it can no longer satisfy the request.
+		if f.allocate(n) == 0 {
+			b.StopTimer()
+			f.ids = append(f.ids[:0], ids...)
+			f.scanFrom, f.largest = 0, 0
+			b.StartTimer()
+		}
+	}
+}
+
+// fragmentedPgids returns a sorted list of page ids made up of the given
+// number of contiguous runs, each between minSize and maxSize pages long and
+// separated by allocated gaps.
+func fragmentedPgids(runs, minSize, maxSize int) []pgid {
+	rand := rand.New(rand.NewSource(42))
+	var ids []pgid
+	id := pgid(2)
+	for i := 0; i < runs; i++ {
+		size := minSize + rand.Intn(maxSize-minSize+1)
+		for j := 0; j < size; j++ {
+			ids = append(ids, id)
+			id++
+		}
+		id += pgid(1 + rand.Intn(8))
+	}
+	return ids
+}
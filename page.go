@@ -19,6 +19,10 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+
+	// freelistChecksumFlag marks a freelist page whose ids are followed by
+	// a checksum element. Pages without it are read unchecked.
+	freelistChecksumFlag = 0x20
 )
 
 const (
@@ -148,9 +152,29 @@ func (a pgids) merge(b pgids) pgids {
 	} else if len(b) == 0 {
 		return a
 	}
+	merged := make(pgids, len(a)+len(b))
+	mergepgids(merged, a, b)
+	return merged
+}
+
+// mergepgids copies the sorted union of a and b into dst.
+// If dst is too small, it panics.
+func mergepgids(dst, a, b pgids) {
+	if len(dst) < len(a)+len(b) {
+		panic(fmt.Errorf("mergepgids bad len %d < %d + %d", len(dst), len(a), len(b)))
+	}
+	// Copy in the opposite slice if one is nil.
+	if len(a) == 0 {
+		copy(dst, b)
+		return
+	}
+	if len(b) == 0 {
+		copy(dst, a)
+		return
+	}
 
-	// Create a list to hold all elements from both lists.
-	merged := make(pgids, 0, len(a)+len(b))
+	// Merged will hold all elements from both lists.
+	merged := dst[:0]
 
 	// Assign lead to the slice with a lower starting value, follow to the higher value.
 	lead, follow := a, b
@@ -172,7 +196,43 @@ func (a pgids) merge(b pgids) pgids {
 	}
 
 	// Append what's left in follow.
-	merged = append(merged, follow...)
+	_ = append(merged, follow...)
+}
 
-	return merged
+// eachRun calls fn with the index and length of each run of consecutive ids
+// in a sorted list, in order. Iteration stops early if fn returns false.
+func (a pgids) eachRun(fn func(i, n int) bool) {
+	for i := 0; i < len(a); {
+		j := i + 1
+		for j < len(a) && a[j] == a[j-1]+1 {
+			j++
+		}
+		if !fn(i, j-i) {
+			return
+		}
+		i = j
+	}
+}
+
+// diff returns the ids that are in b but not in a and the ids that are in a
+// but not in b. Both lists must be sorted.
+func (a pgids) diff(b pgids) (added, removed pgids) {
+	return b.difference(a), a.difference(b)
+}
+
+// difference returns the ids in a that do not appear in b, in a single pass.
+// Both lists must be sorted.
+func (a pgids) difference(b pgids) pgids {
+	var d pgids
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			d, a = append(d, a[0]), a[1:]
+		case b[0] < a[0]:
+			b = b[1:]
+		default:
+			a = a[1:]
+		}
+	}
+	return append(d, a...)
 }
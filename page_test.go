@@ -70,3 +70,65 @@ func TestPgids_merge_quick(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPgids_eachRun(t *testing.T) {
+	var runs [][2]int
+	pgids{3, 4, 5, 9, 11, 12}.eachRun(func(i, n int) bool {
+		runs = append(runs, [2]int{i, n})
+		return len(runs) < 2
+	})
+	if !reflect.DeepEqual(runs, [][2]int{{0, 3}, {3, 1}}) {
+		t.Errorf("mismatch: %v", runs)
+	}
+}
+
+func TestPgids_diff(t *testing.T) {
+	a := pgids{3, 4, 5, 9, 12}
+	b := pgids{2, 4, 5, 10, 12, 14}
+	added, removed := a.diff(b)
+	if !reflect.DeepEqual(added, pgids{2, 10, 14}) {
+		t.Errorf("added mismatch: %v", added)
+	}
+	if !reflect.DeepEqual(removed, pgids{3, 9}) {
+		t.Errorf("removed mismatch: %v", removed)
+	}
+}
+
+func TestPgids_difference(t *testing.T) {
+	a := pgids{3, 4, 5, 9, 12}
+	b := pgids{2, 4, 5, 10, 12, 14}
+	if d := a.difference(b); !reflect.DeepEqual(d, pgids{3, 9}) {
+		t.Errorf("mismatch: %v", d)
+	}
+	if d := a.difference(nil); !reflect.DeepEqual(d, a) {
+		t.Errorf("mismatch: %v", d)
+	}
+}
+
+func TestPgids_difference_quick(t *testing.T) {
+	if err := quick.Check(func(a, b pgids) bool {
+		sort.Sort(a)
+		sort.Sort(b)
+		got := a.difference(b)
+
+		// The expected value is a filtered by membership in b.
+		m := make(map[pgid]bool)
+		for _, id := range b {
+			m[id] = true
+		}
+		var exp pgids
+		for _, id := range a {
+			if !m[id] {
+				exp = append(exp, id)
+			}
+		}
+
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("\nexp=%+v\ngot=%+v\n", exp, got)
+			return false
+		}
+		return true
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
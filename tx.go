@@ -252,7 +252,11 @@ func (tx *Tx) rollback() {
 	}
 	if tx.writable {
 		tx.db.freelist.rollback(tx.meta.txid)
-		tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+
+		// A freelist page that cannot be read leaves the freelist as it was,
+		// which only strands the pages this transaction allocated.
+		tx.db.freelist.highWater = tx.db.meta().pgid
+		_, _, _ = tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
 	}
 	tx.close()
 }